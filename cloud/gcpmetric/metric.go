@@ -2,23 +2,27 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package gcpmetric implements a metric.Saver that records metrics with
+// Package gcpmetric implements metric.Savers that record metrics with
 // Google's Cloud Trace API.
 package gcpmetric // import "gcp.upspin.io/cloud/gcpmetric"
 
 import (
+	"expvar"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	trace "google.golang.org/api/cloudtrace/v1"
+	cloudtrace "google.golang.org/api/cloudtrace/v2"
 
 	"upspin.io/errors"
 	"upspin.io/log"
 	"upspin.io/metric"
 	"upspin.io/serverutil"
+	"upspin.io/shutdown"
 )
 
 // traceSaver is an interface to cloudtrace API. It is used mostly for testing.
@@ -27,27 +31,77 @@ type traceSaver interface {
 	Save(*trace.Traces) error
 }
 
-// gcpSaver is a Saver that saves to GCP Traces.
+// gcpSaver is a Saver that saves to GCP Traces, with either version 1 of
+// the Cloud Trace API, through api, or version 2, through spans.
 type gcpSaver struct {
 	projectID    string
 	api          traceSaver
+	spans        spanWriter // If set, api is not used.
 	saverQueue   chan *metric.Metric
 	staticLabels map[string]string
-	n            int // sampling 1 out of every n metrics.
+	sampler      Sampler
 	rate         *serverutil.RateLimiter
+
+	uploads   chan *batch        // Batches for uploadLoop to save.
+	flushes   chan chan struct{} // Requests to Flush.
+	closing   chan struct{}      // Closed by Close.
+	closed    chan struct{}      // Closed when uploadLoop is done.
+	closeOnce sync.Once
 }
 
 var _ metric.Saver = (*gcpSaver)(nil)
 
+// Limits on the metrics buffered by a saver. A batch of up to maxBatch
+// metrics is filled while up to maxPendingBatches earlier batches wait to
+// be saved and another is being saved. When that buffer is full, newly
+// done metrics are dropped.
+const (
+	maxBatch          = metric.SaveQueueLength / 2
+	maxPendingBatches = 4
+)
+
+// BufferedSaver is implemented by the metric.Savers of this package,
+// which buffer metrics and save them in batches. Buffered metrics are
+// saved when the server shuts down, through the upspin.io/shutdown
+// package.
+type BufferedSaver interface {
+	metric.Saver
+
+	// Flush saves the metrics buffered so far, returning once they
+	// have been saved or have failed to save.
+	Flush()
+
+	// Close flushes the saver and stops it. Metrics done after it
+	// is closed are not saved.
+	Close()
+}
+
+// Guarantee we implement the BufferedSaver interface.
+var _ BufferedSaver = (*gcpSaver)(nil)
+
+// saverStats holds counters of the savers' work, published as the expvar
+// "gcpmetric". They are shared by all savers.
+var saverStats = expvar.NewMap("gcpmetric")
+
+// Names of the counters in saverStats.
+const (
+	statDropped  = "dropped"  // Metrics dropped because the buffer was full.
+	statExported = "exported" // Batches saved.
+	statFailed   = "failed"   // Batches that failed to save.
+)
+
 // onFlush is called when data is saved to the backend. It's used in tests only.
 var onFlush = func() {}
 
 // NewSaver returns a metric.Saver that saves metrics to GCP Traces for a GCP
 // projectID. The caller must have enabled the StackDriver Traces API for the
 // projectID and have sufficient permission to use the scope "cloud-platform".
+// It uses version 1 of the Cloud Trace API; NewSpanSaver, which uses
+// version 2, is preferred.
 //
-// A random sampling ratio of 1-to-n is taken.
-// Setting n to 1 reports every event.
+// A sampling ratio of 1-to-n is taken, by trace as described by HeadSampler.
+// Setting n to 1 reports every event. SetSampler changes how metrics
+// are sampled.
 //
 // A maximum number of outbound network requests per second (maxQPS) when
 // uploading metrics to the GCP backend is enforced. Values equal to or larger
@@ -64,16 +118,29 @@ func NewSaver(projectID string, n, maxQPS int, labels ...string) (metric.Saver,
 	if err != nil {
 		return nil, errors.E(op, errors.Internal, errors.Errorf("unable to get default client: %v", err))
 	}
-	if n < 1 {
-		return nil, errors.E(op, errors.Invalid, errors.Errorf("invalid sampling rate n=%d", n))
+	g, err := newGCPSaver(projectID, n, maxQPS, labels)
+	if err != nil {
+		return nil, errors.E(op, err)
 	}
-
 	srv, err := trace.New(client)
 	if err != nil {
 		return nil, errors.E(op, errors.IO, err)
 	}
+	g.api = &traceSaverImpl{
+		projectID: projectID,
+		api:       srv.Projects,
+	}
+	return g, nil
+}
+
+// newGCPSaver returns a gcpSaver with the given parameters, as described
+// by NewSaver, but without a connection to the Cloud Trace API.
+func newGCPSaver(projectID string, n, maxQPS int, labels []string) (*gcpSaver, error) {
+	if n < 1 {
+		return nil, errors.E(errors.Invalid, errors.Errorf("invalid sampling rate n=%d", n))
+	}
 	if len(labels)%2 != 0 {
-		return nil, errors.E(op, errors.Invalid, "metric labels must come in pairs")
+		return nil, errors.E(errors.Invalid, "metric labels must come in pairs")
 	}
 
 	var rate *serverutil.RateLimiter
@@ -87,83 +154,179 @@ func NewSaver(projectID string, n, maxQPS int, labels ...string) (metric.Saver,
 	rand.Seed(time.Now().Unix())
 
 	return &gcpSaver{
-		projectID: projectID,
-		api: &traceSaverImpl{
-			projectID: projectID,
-			api:       srv.Projects,
-		},
+		projectID:    projectID,
 		staticLabels: makeLabels(labels),
-		n:            n,
+		sampler:      HeadSampler(n),
 		rate:         rate,
 	}, nil
 }
 
 func (g *gcpSaver) Register(queue chan *metric.Metric) {
 	g.saverQueue = queue
+	g.uploads = make(chan *batch, maxPendingBatches)
+	g.flushes = make(chan chan struct{})
+	g.closing = make(chan struct{})
+	g.closed = make(chan struct{})
 	go g.saverLoop()
+	go g.uploadLoop()
+	shutdown.Handle(g.Close)
+}
+
+// Flush implements BufferedSaver.
+func (g *gcpSaver) Flush() {
+	if g.flushes == nil {
+		// Not registered.
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case g.flushes <- done:
+		<-done
+	case <-g.closing:
+	}
 }
 
+// Close implements BufferedSaver.
+func (g *gcpSaver) Close() {
+	if g.closing == nil {
+		// Not registered.
+		return
+	}
+	g.closeOnce.Do(func() { close(g.closing) })
+	<-g.closed
+}
+
+// saverLoop reads metrics from the queue and buffers them in batches
+// for uploadLoop to save, so that slow saves do not hold up the queue.
 func (g *gcpSaver) saverLoop() {
 	const idleTimeout = time.Hour
-	var (
-		batchTimeout time.Duration
-		traces       []*trace.Trace
-	)
+	var batchTimeout time.Duration
 	if g.rate != nil {
 		batchTimeout = g.rate.Backoff
 	} else {
 		batchTimeout = 50 * time.Millisecond
 	}
-	maybeSave := func() bool {
-		if g.rate != nil {
-			if pass, _ := g.rate.Pass("metric"); !pass {
-				return false
-			}
+	b := new(batch)
+	// send hands the batch to uploadLoop if it has room,
+	// and reports whether it did.
+	send := func() bool {
+		select {
+		case g.uploads <- b:
+			b = new(batch)
+			return true
+		default:
+			return false
 		}
-		g.save(traces)
-		traces = traces[:0]
-		return true
 	}
 	timer := time.NewTimer(idleTimeout)
 	for {
 		select {
 		case m := <-g.saverQueue:
-			if len(traces) >= metric.SaveQueueLength/2 {
-				// Buffer is half full. Start trying to save.
-				maybeSave()
+			traceID := makeTraceID()
+			if !g.sampler.Sample(traceID, m) {
+				continue
 			}
-			if g.n > 1 {
-				// Only 1 out every n is buffered to be saved.
-				if rand.Intn(g.n) > 0 {
-					continue
-				}
+			if b.n >= maxBatch && !send() {
+				// The buffer is full. Drop the new metric, so
+				// that the older buffered ones are saved first.
+				saverStats.Add(statDropped, 1)
+				continue
 			}
 			// Buffer metric for later.
-			traces = append(traces, g.prepareToSave(m))
+			g.add(b, m, traceID)
 			// While we're getting new metrics, reset the timer so
-			// we have time to fill the buffer.
+			// we have time to fill the batch.
 			if !timer.Stop() {
 				<-timer.C
 			}
 			timer.Reset(batchTimeout)
 		case <-timer.C:
-			// Timer expired. Try to flush if there's anything
-			// buffered.
-			if len(traces) == 0 || maybeSave() {
-				// Nothing left to save. Revert to the long
+			// Timer expired. Try to send the batch if there's
+			// anything in it.
+			if b.n == 0 || send() {
+				// Nothing left to send. Revert to the long
 				// timeout.
 				timer.Reset(idleTimeout)
 			} else {
-				// Buffered metrics remain. Try again soon.
+				// The uploader is busy. Try again soon.
 				timer.Reset(batchTimeout)
 			}
+		case done := <-g.flushes:
+			if b.n > 0 {
+				g.uploads <- b
+				b = new(batch)
+			}
+			g.uploads <- &batch{done: done}
+		case <-g.closing:
+			timer.Stop()
+			if b.n > 0 {
+				g.uploads <- b
+			}
+			close(g.uploads)
+			return
 		}
 	}
 }
 
-// save serializes the metric in a GCP-friendly way and saves it to the
-// specific GCP backend configured when the Saver was created.
-func (g *gcpSaver) prepareToSave(m *metric.Metric) *trace.Trace {
+// uploadLoop saves the batches sent by saverLoop, within the rate limit.
+func (g *gcpSaver) uploadLoop() {
+	defer close(g.closed)
+	for b := range g.uploads {
+		if b.done != nil {
+			// The batches before it have been saved.
+			close(b.done)
+			continue
+		}
+		for g.rate != nil {
+			pass, wait := g.rate.Pass("metric")
+			if pass {
+				break
+			}
+			time.Sleep(wait)
+		}
+		if err := g.flush(b); err != nil {
+			saverStats.Add(statFailed, 1)
+		} else {
+			saverStats.Add(statExported, 1)
+		}
+	}
+}
+
+// batch holds the metrics buffered for saving, serialized for the
+// version of the Cloud Trace API in use.
+type batch struct {
+	n      int                // Number of metrics in the batch.
+	traces []*trace.Trace     // For version 1.
+	spans  []*cloudtrace.Span // For version 2.
+
+	// done, if set, marks a batch with no metrics that is closed
+	// by uploadLoop once the batches sent before it are saved.
+	done chan struct{}
+}
+
+// add serializes the metric, which is saved as the trace with
+// the given ID, and adds it to the batch.
+func (g *gcpSaver) add(b *batch, m *metric.Metric, traceID string) {
+	if g.spans != nil {
+		b.spans = append(b.spans, g.prepareSpans(m, traceID)...)
+	} else {
+		b.traces = append(b.traces, g.prepareToSave(m, traceID))
+	}
+	b.n++
+}
+
+// flush saves the batch to the GCP backend configured
+// when the Saver was created.
+func (g *gcpSaver) flush(b *batch) error {
+	if g.spans != nil {
+		return g.saveSpans(b.spans)
+	}
+	return g.save(b.traces)
+}
+
+// prepareToSave serializes the metric in a GCP-friendly way,
+// for version 1 of the Cloud Trace API.
+func (g *gcpSaver) prepareToSave(m *metric.Metric, traceID string) *trace.Trace {
 	spans := m.Spans()
 	traceSpans := make([]*trace.TraceSpan, len(spans))
 	for i, s := range spans {
@@ -189,12 +352,12 @@ func (g *gcpSaver) prepareToSave(m *metric.Metric) *trace.Trace {
 	}
 	return &trace.Trace{
 		ProjectId: g.projectID,
-		TraceId:   makeTraceID(),
+		TraceId:   traceID,
 		Spans:     traceSpans,
 	}
 }
 
-func (g *gcpSaver) save(traces []*trace.Trace) {
+func (g *gcpSaver) save(traces []*trace.Trace) error {
 	batch := &trace.Traces{
 		Traces: traces,
 	}
@@ -203,6 +366,7 @@ func (g *gcpSaver) save(traces []*trace.Trace) {
 		log.Error.Printf("metric: error saving to GCP: %v", err)
 	}
 	onFlush()
+	return err
 }
 
 func toKindString(k metric.Kind) string {
@@ -5,13 +5,23 @@
 package gcpmetric
 
 import (
+	"errors"
+	"expvar"
+	"fmt"
 	"math/rand"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gcp.upspin.io/cloud/spanerr"
 
 	"upspin.io/metric"
 
 	trace "google.golang.org/api/cloudtrace/v1"
+	cloudtrace "google.golang.org/api/cloudtrace/v2"
+	monitoring "google.golang.org/api/monitoring/v3"
 )
 
 func TestLabelsAndAnnotations(t *testing.T) {
@@ -22,7 +32,7 @@ func TestLabelsAndAnnotations(t *testing.T) {
 	m.StartSpan("Span2").End()
 	m.Done()
 
-	newTrace := saver.prepareToSave(m)
+	newTrace := saver.prepareToSave(m, makeTraceID())
 	saver.save([]*trace.Trace{newTrace})
 
 	// Sink should have one trace with two spans, both with the static labels and one with an annotation (the last one).
@@ -63,7 +73,7 @@ func TestNoLabelsAndAnnotation(t *testing.T) {
 	m.StartSpan("Span2").End()
 	m.Done()
 
-	newTrace := saver.prepareToSave(m)
+	newTrace := saver.prepareToSave(m, makeTraceID())
 	saver.save([]*trace.Trace{newTrace})
 
 	// Sink should have one trace with two spans, one with an annotation.
@@ -88,7 +98,8 @@ func TestNoLabelsAndAnnotation(t *testing.T) {
 	}
 }
 func TestSampling(t *testing.T) {
-	// We know the sequence with this random seed, so test is deterministic.
+	// We know the sequence of trace IDs with this random seed,
+	// so test is deterministic.
 	rand.Seed(1234)
 
 	sink := new(sinkTraces)
@@ -117,30 +128,462 @@ func TestSampling(t *testing.T) {
 	<-done
 
 	// We expect about 1/10th were sampled, which is 10, but it's
-	// probabilistic. 14 is what we get with the rand seed above.
+	// probabilistic. 11 is what we get with the rand seed above.
 	if len(sink.traces) != 1 {
 		t.Fatalf("sink contains %d traces, want 1", len(sink.traces))
 	}
-	if traces := sink.traces[0].Traces; len(traces) != 14 {
-		t.Errorf("saved = %d, want = 14 ", len(traces))
+	if traces := sink.traces[0].Traces; len(traces) != 11 {
+		t.Errorf("saved = %d, want = 11 ", len(traces))
+	}
+}
+
+func TestHeadSampler(t *testing.T) {
+	s := HeadSampler(10)
+	m := metric.New("metric")
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		id := makeTraceID()
+		got := s.Sample(id, m)
+		// The decision depends on the trace ID alone.
+		if HeadSampler(10).Sample(id, metric.New("other")) != got {
+			t.Fatalf("inconsistent sampling of trace %s", id)
+		}
+		if got {
+			kept++
+		}
+	}
+	if kept < 50 || kept > 150 {
+		t.Errorf("kept %d of 1000 traces, want about 100", kept)
+	}
+	for _, n := range []int{1, 0, -1} {
+		if !HeadSampler(n).Sample(makeTraceID(), m) {
+			t.Errorf("HeadSampler(%d) dropped a trace", n)
+		}
+	}
+}
+
+func TestTailSampling(t *testing.T) {
+	sink := new(sinkTraces)
+	saver := newDummyGCPSaver(sink, 1, 1000)
+	saver.SetSampler(TailSampler{Latency: time.Hour})
+
+	done := make(chan bool)
+	onFlush = func() {
+		done <- true
+	}
+	defer func() {
+		onFlush = func() {}
+	}()
+
+	queue := make(chan *metric.Metric, 100)
+	saver.Register(queue)
+
+	now := time.Now()
+	fast, _ := metric.NewSpan("fast")
+	failed, span := metric.NewSpan("failed")
+	span.StartSpan("call").SetAnnotation("bucket=b status=404 error").End()
+	slow, span := metric.NewSpan("slow")
+	for _, m := range []*metric.Metric{fast, failed, slow} {
+		for _, s := range m.Spans() {
+			s.End()
+		}
+	}
+	span.StartTime = now.Add(-2 * time.Hour)
+	queue <- fast
+	queue <- failed
+	queue <- slow
+
+	<-done
+
+	if len(sink.traces) != 1 {
+		t.Fatalf("sink contains %d traces, want 1", len(sink.traces))
+	}
+	var got []string
+	for _, tr := range sink.traces[0].Traces {
+		got = append(got, tr.Spans[0].Name)
+	}
+	if want := []string{"failed", "slow"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("saved %q, want %q", got, want)
+	}
+
+	// Without a latency, errors are saved and the rest left to Head.
+	if !(TailSampler{}).Sample(makeTraceID(), failed) {
+		t.Error("TailSampler without Latency dropped an error")
+	}
+	if (TailSampler{}).Sample(makeTraceID(), slow) {
+		t.Error("TailSampler without Latency or Head saved a slow metric")
+	}
+	if !(TailSampler{Head: HeadSampler(1)}).Sample(makeTraceID(), fast) {
+		t.Error("TailSampler without Latency did not defer to Head")
+	}
+}
+
+func TestSpans(t *testing.T) {
+	sink := new(sinkSpans)
+	saver := newDummyGCPSaver(nil, 1, 1000, "serverName", "test")
+	saver.spans = sink
+
+	m, root := metric.NewSpan("root")
+	root.SetKind(metric.Server)
+	child := root.StartSpan("child").SetKind(metric.Client).SetAnnotation("status=200")
+	child.End()
+	root.End()
+	m.Done()
+
+	var b batch
+	saver.add(&b, m, makeTraceID())
+	saver.flush(&b)
+
+	if len(sink.reqs) != 1 {
+		t.Fatalf("sink contains %d requests, want 1", len(sink.reqs))
+	}
+	spans := sink.reqs[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	s1, s2 := spans[0], spans[1]
+	if got, want := s1.DisplayName.Value, "root"; got != want {
+		t.Errorf("span one is named %q, want %q", got, want)
+	}
+	if got, want := s2.DisplayName.Value, "child"; got != want {
+		t.Errorf("span two is named %q, want %q", got, want)
+	}
+	if s1.ParentSpanId != "" {
+		t.Errorf("root span has parent %q", s1.ParentSpanId)
+	}
+	if s2.ParentSpanId != s1.SpanId {
+		t.Errorf("child span has parent %q, want %q", s2.ParentSpanId, s1.SpanId)
+	}
+	if len(s1.SpanId) != 16 || s1.SpanId == s2.SpanId {
+		t.Errorf("bad span IDs %q and %q", s1.SpanId, s2.SpanId)
+	}
+	traceID := strings.Split(s1.Name, "/")[3]
+	if len(traceID) != 32 {
+		t.Errorf("bad trace ID %q", traceID)
+	}
+	if want := "projects/test/traces/" + traceID + "/spans/" + s2.SpanId; s2.Name != want {
+		t.Errorf("span two has resource name %q, want %q", s2.Name, want)
+	}
+	if s1.SpanKind != "SERVER" || s2.SpanKind != "CLIENT" {
+		t.Errorf("got span kinds %q and %q, want SERVER and CLIENT", s1.SpanKind, s2.SpanKind)
+	}
+	for _, s := range spans {
+		if got := s.Attributes.AttributeMap["serverName"].StringValue.Value; got != "test" {
+			t.Errorf("span %q has serverName %q, want %q", s.DisplayName.Value, got, "test")
+		}
+	}
+	if s1.TimeEvents != nil {
+		t.Errorf("root span has annotations")
+	}
+	if s2.TimeEvents == nil || s2.TimeEvents.TimeEvent[0].Annotation.Description.Value != "status=200" {
+		t.Errorf("child span lacks its annotation")
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	saver := newDummyGCPSaver(sink, 1, 1000)
+	// Save only failed metrics, so that those not sampled don't
+	// count as dropped once the buffer is full.
+	saver.SetSampler(TailSampler{})
+	queue := make(chan *metric.Metric, metric.SaveQueueLength)
+	saver.Register(queue)
+
+	dropped, exported := stat(statDropped), stat(statExported)
+	// More than the buffer holds while a save is in progress,
+	// each followed by one that is not sampled.
+	total := maxBatch*(maxPendingBatches+2) + 100
+	for i := 0; i < 2*total; i++ {
+		m, s := metric.NewSpan("overflow")
+		if i%2 == 0 {
+			s.SetAnnotation(spanerr.Mark(""))
+		}
+		s.End()
+		select {
+		case queue <- m:
+		case <-time.After(10 * time.Second):
+			t.Fatal("saver stopped reading its queue")
+		}
+	}
+	// Let the saver read the rest of its queue.
+	for len(queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(sink.release)
+	saver.Close()
+
+	saved := 0
+	for _, traces := range sink.traces {
+		saved += len(traces.Traces)
+	}
+	if got := stat(statDropped) - dropped; got < 100 || int(got)+saved != total {
+		t.Errorf("saved %d and dropped %d of %d metrics", saved, got, total)
+	}
+	if got := stat(statExported) - exported; got != int64(len(sink.traces)) {
+		t.Errorf("exported %d batches, want %d", got, len(sink.traces))
+	}
+}
+
+func TestFlush(t *testing.T) {
+	sink := &failingSink{}
+	saver := newDummyGCPSaver(sink, 1, 1000)
+	queue := make(chan *metric.Metric, 10)
+	saver.Register(queue)
+	defer saver.Close()
+
+	failed := stat(statFailed)
+	m, s := metric.NewSpan("flush")
+	s.End()
+	queue <- m
+	// Wait for the saver to read the metric before flushing.
+	for len(queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	saver.Flush()
+	if sink.calls != 1 {
+		t.Errorf("Flush made %d calls to save, want 1", sink.calls)
+	}
+	if got := stat(statFailed) - failed; got != 1 {
+		t.Errorf("failed %d batches, want 1", got)
+	}
+}
+
+func TestMonitoring(t *testing.T) {
+	if _, err := newMonitoringSaver("test", time.Second, nil); err == nil {
+		t.Error("short period accepted")
+	}
+	for _, label := range []string{"op", "kind", "instance"} {
+		if _, err := newMonitoringSaver("test", time.Hour, []string{label, "x"}); err == nil {
+			t.Errorf("reserved label %q accepted", label)
+		}
+	}
+
+	defer func(d time.Duration) { writeSpacing = d }(writeSpacing)
+	writeSpacing = 100 * time.Millisecond
+
+	sink := new(sinkSeries)
+	saver, err := newMonitoringSaver("test", time.Hour, []string{"serverName", "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver.api = sink
+	queue := make(chan *metric.Metric, 10)
+	saver.Register(queue)
+	defer saver.Close()
+
+	now := time.Now()
+	m, root := metric.NewSpan("Put")
+	root.StartTime, root.EndTime = now, now.Add(5*time.Millisecond)
+	queue <- m
+	m, root = metric.NewSpan("Put")
+	call := root.StartSpan("cloud/storage/gcs.Insert").SetKind(metric.Client).SetAnnotation("status=503 error")
+	root.StartTime, root.EndTime = now, now.Add(3*time.Second)
+	call.StartTime, call.EndTime = now, now.Add(2*time.Second)
+	queue <- m
+	for len(queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	saver.Flush()
+
+	if len(sink.reqs) != 1 {
+		t.Fatalf("sink contains %d requests, want 1", len(sink.reqs))
+	}
+	series := sink.reqs[0].TimeSeries
+	if len(series) != 6 {
+		t.Fatalf("got %d time series, want 6", len(series))
+	}
+	find := func(metricType, op string) *monitoring.TimeSeries {
+		for _, ts := range series {
+			if ts.Metric.Type == metricType && ts.Metric.Labels["op"] == op {
+				return ts
+			}
+		}
+		t.Fatalf("no %s time series for %s", metricType, op)
+		return nil
+	}
+	for _, c := range []struct {
+		metricType, op string
+		want           int64
+	}{
+		{requestCountMetric, "Put", 2},
+		{errorCountMetric, "Put", 0},
+		{requestCountMetric, "cloud/storage/gcs.Insert", 1},
+		{errorCountMetric, "cloud/storage/gcs.Insert", 1},
+	} {
+		if got := *find(c.metricType, c.op).Points[0].Value.Int64Value; got != c.want {
+			t.Errorf("%s for %s = %d, want %d", c.metricType, c.op, got, c.want)
+		}
+	}
+	ts := find(latencyMetric, "Put")
+	if got := ts.Metric.Labels; got["serverName"] != "test" || got["kind"] != "server" || got["instance"] != instance(saver.start) {
+		t.Errorf("latency of Put has labels %v", got)
+	}
+	if ts.MetricKind != "CUMULATIVE" || ts.Resource.Type != "global" || ts.Resource.Labels["project_id"] != "test" {
+		t.Errorf("bad time series %+v", ts)
+	}
+	d := ts.Points[0].Value.DistributionValue
+	if d.Count != 2 || d.Mean != 1502.5 {
+		t.Errorf("latency of Put has count %d and mean %v, want 2 and 1502.5", d.Count, d.Mean)
+	}
+	// 5ms and 3s fall in the buckets for [4ms, 8ms) and [2048ms, 4096ms).
+	for i, n := range d.BucketCounts {
+		want := int64(0)
+		if i == 3 || i == 12 {
+			want = 1
+		}
+		if n != want {
+			t.Errorf("latency bucket %d of Put holds %d, want %d", i, n, want)
+		}
+	}
+	if got := find(latencyMetric, "cloud/storage/gcs.Insert").Metric.Labels["kind"]; got != "client" {
+		t.Errorf("Insert has kind %q, want client", got)
+	}
+
+	// Writes are split to fit the API's limit.
+	for i := 0; i < 70; i++ {
+		m, root := metric.NewSpan(metric.SpanName(fmt.Sprintf("op%d", i)))
+		root.End()
+		queue <- m
+	}
+	for len(queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	saver.Flush()
+	if len(sink.reqs) != 3 {
+		t.Fatalf("sink contains %d requests, want 3", len(sink.reqs))
+	}
+	if got := len(sink.reqs[1].TimeSeries) + len(sink.reqs[2].TimeSeries); got != 3*72 {
+		t.Errorf("wrote %d time series, want %d", got, 3*72)
+	}
+
+	// Points of a time series are written at least writeSpacing apart.
+	first, err := time.Parse(time.RFC3339Nano, sink.reqs[0].TimeSeries[0].Points[0].Interval.EndTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := time.Parse(time.RFC3339Nano, sink.reqs[1].TimeSeries[0].Points[0].Interval.EndTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := second.Sub(first); d < writeSpacing {
+		t.Errorf("points written %v apart, want at least %v", d, writeSpacing)
 	}
 }
 
+func TestMulti(t *testing.T) {
+	defer func(d time.Duration) { writeSpacing = d }(writeSpacing)
+	writeSpacing = time.Millisecond
+
+	traces := new(sinkTraces)
+	tracer := newDummyGCPSaver(traces, 1, 1000)
+	series := new(sinkSeries)
+	monitor, err := newMonitoringSaver("test", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.api = series
+	saver := Multi(tracer, monitor)
+	queue := make(chan *metric.Metric, 10)
+	saver.Register(queue)
+
+	m, s := metric.NewSpan("multi")
+	s.End()
+	queue <- m
+	// Flush until both savers have read the metric from their own queues.
+	b := saver.(BufferedSaver)
+	defer b.Close()
+	for i := 0; i < 1000 && (traces.saved() == 0 || series.written() == 0); i++ {
+		time.Sleep(time.Millisecond)
+		b.Flush()
+	}
+	if n, m := traces.saved(), series.written(); n != 1 || m == 0 {
+		t.Errorf("savers saved %d batches of traces and %d of time series, want 1 and at least 1", n, m)
+	}
+}
+
+// stat returns the value of the named counter in saverStats.
+func stat(name string) int64 {
+	v, _ := saverStats.Get(name).(*expvar.Int)
+	if v == nil {
+		return 0
+	}
+	return v.Value()
+}
+
 func newDummyGCPSaver(s traceSaver, n int, maxQPS int, labels ...string) *gcpSaver {
 	saver := &gcpSaver{
 		projectID:    "test",
 		api:          s,
 		staticLabels: makeLabels(labels),
-		n:            n,
+		sampler:      HeadSampler(n),
 	}
 	return saver
 }
 
 type sinkTraces struct {
+	mu     sync.Mutex
 	traces []*trace.Traces
 }
 
 func (s *sinkTraces) Save(traces *trace.Traces) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.traces = append(s.traces, traces)
 	return nil
 }
+
+// saved returns the number of batches saved so far.
+func (s *sinkTraces) saved() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.traces)
+}
+
+type sinkSpans struct {
+	reqs []*cloudtrace.BatchWriteSpansRequest
+}
+
+func (s *sinkSpans) Write(req *cloudtrace.BatchWriteSpansRequest) error {
+	s.reqs = append(s.reqs, req)
+	return nil
+}
+
+// blockingSink is a traceSaver that saves once release is closed.
+type blockingSink struct {
+	sinkTraces
+	release chan struct{}
+}
+
+func (s *blockingSink) Save(traces *trace.Traces) error {
+	<-s.release
+	return s.sinkTraces.Save(traces)
+}
+
+// failingSink is a traceSaver that always fails.
+type failingSink struct {
+	calls int
+}
+
+func (s *failingSink) Save(traces *trace.Traces) error {
+	s.calls++
+	return errors.New("failed")
+}
+
+type sinkSeries struct {
+	mu   sync.Mutex
+	reqs []*monitoring.CreateTimeSeriesRequest
+}
+
+func (s *sinkSeries) Write(req *monitoring.CreateTimeSeriesRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, req)
+	return nil
+}
+
+// written returns the number of requests written so far.
+func (s *sinkSeries) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.reqs)
+}
@@ -0,0 +1,460 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcpmetric
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gcp.upspin.io/cloud/spanerr"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	monitoring "google.golang.org/api/monitoring/v3"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/metric"
+	"upspin.io/shutdown"
+)
+
+// The monitoring saver aggregates the spans of every metric, by span name
+// and kind, into the following custom metrics. Each has the labels
+//
+//	op        the span name, such as "cloud/storage/gcs.Put"
+//	kind      "server", "client" or "internal"
+//	instance  the saver's host, process ID and start time, in seconds,
+//	          such as "upspin-store-1/12/1760659200"
+//
+// as well as the static labels given to NewMonitoringSaver. The values are
+// cumulative since the saver started, so a failed write loses nothing. As
+// the values of each process are its own, its time series are told apart
+// from those of other processes, even ones that run at the same time and
+// with the same static labels, by the instance label.
+const (
+	// requestCountMetric counts the spans.
+	requestCountMetric = "custom.googleapis.com/upspin/request_count"
+
+	// errorCountMetric counts the spans annotated as errors,
+	// as reported by spanerr.Is.
+	errorCountMetric = "custom.googleapis.com/upspin/error_count"
+
+	// latencyMetric is the distribution of the spans' durations,
+	// in milliseconds.
+	latencyMetric = "custom.googleapis.com/upspin/latency"
+)
+
+// Latencies are counted in exponential buckets, the first of which holds
+// latencies under latencyScale milliseconds and the last those of at least
+// latencyScale * latencyGrowth^latencyBuckets milliseconds, about 17 minutes.
+const (
+	latencyScale   = 1.0
+	latencyGrowth  = 2.0
+	latencyBuckets = 20 // Not counting the first and last.
+)
+
+// maxSeriesPerWrite is the number of time series that the Cloud Monitoring
+// API accepts in one request.
+const maxSeriesPerWrite = 200
+
+// minMonitoringPeriod is the shortest interval between writes that the
+// Cloud Monitoring API accepts for a time series.
+const minMonitoringPeriod = 10 * time.Second
+
+// writeSpacing is the shortest interval between the end times of the
+// points written for a time series. It is a variable so that tests may
+// change it.
+var writeSpacing = minMonitoringPeriod
+
+// timeSeriesWriter is an interface to the monitoring API.
+// It is used mostly for testing.
+type timeSeriesWriter interface {
+	// Write writes the time series to GCP.
+	Write(*monitoring.CreateTimeSeriesRequest) error
+}
+
+// monitoringSaver is a Saver that saves aggregates of metrics
+// to Cloud Monitoring.
+type monitoringSaver struct {
+	projectID    string
+	api          timeSeriesWriter
+	staticLabels map[string]string
+	period       time.Duration
+	start        time.Time // The start of the cumulative values.
+
+	saverQueue chan *metric.Metric
+	stats      map[opKey]*opStats // Accessed only by saverLoop.
+
+	writes    chan *seriesWrite // Writes for writeLoop to make.
+	flushes   chan chan struct{}
+	closing   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Guarantee we implement the BufferedSaver interface.
+var _ BufferedSaver = (*monitoringSaver)(nil)
+
+// opKey identifies the spans that are aggregated together.
+type opKey struct {
+	op   metric.SpanName
+	kind metric.Kind
+}
+
+// opStats holds the aggregates of the spans of one opKey.
+type opStats struct {
+	requests int64
+	errors   int64
+	buckets  [latencyBuckets + 2]int64
+	mean     float64 // Of the latencies, in milliseconds.
+	sumSq    float64 // Sum of squared deviations from the mean.
+}
+
+// seriesWrite is a write of time series by writeLoop.
+type seriesWrite struct {
+	series []*monitoring.TimeSeries
+
+	// done, if set, is closed by writeLoop once the writes
+	// sent before it are made.
+	done chan struct{}
+}
+
+// NewMonitoringSaver returns a metric.Saver that saves request counts,
+// error counts and latency distributions of the spans of metrics as custom
+// metrics in Cloud Monitoring for a GCP projectID, every period. The caller
+// must have enabled the Cloud Monitoring API for the projectID and have
+// sufficient permission to use the scope "monitoring.write".
+//
+// An optional set of string key-value pairs can be given and they will be
+// saved as labels of every metric, as with NewSaver. Every metric is
+// aggregated; there is no sampling.
+//
+// A span counts as an error only if its annotation was marked by
+// spanerr.Mark, as the GCS storage backend marks the operations and Cloud
+// Storage calls that fail. Other spans, including those of servers that
+// returned an error to their client without marking their span, count
+// only as requests. Spans that never ended are not counted at all.
+//
+// The saver writes at most once every 10 seconds, as the API requires, so
+// Flush and Close may wait that long after a previous write.
+//
+// As metric.RegisterSaver registers a single saver, use Multi to register
+// the saver alongside one that saves traces.
+func NewMonitoringSaver(projectID string, period time.Duration, labels ...string) (metric.Saver, error) {
+	const op errors.Op = "gcpmetric.NewMonitoringSaver"
+	client, err := google.DefaultClient(context.Background(), monitoring.MonitoringWriteScope)
+	if err != nil {
+		return nil, errors.E(op, errors.Internal, errors.Errorf("unable to get default client: %v", err))
+	}
+	g, err := newMonitoringSaver(projectID, period, labels)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	srv, err := monitoring.New(client)
+	if err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	}
+	g.api = &timeSeriesWriterImpl{
+		projectID: projectID,
+		api:       srv.Projects.TimeSeries,
+	}
+	return g, nil
+}
+
+// newMonitoringSaver returns a monitoringSaver with the given parameters,
+// as described by NewMonitoringSaver, but without a connection to the
+// monitoring API.
+func newMonitoringSaver(projectID string, period time.Duration, labels []string) (*monitoringSaver, error) {
+	if period < minMonitoringPeriod {
+		return nil, errors.E(errors.Invalid, errors.Errorf("period %v is shorter than %v", period, minMonitoringPeriod))
+	}
+	if len(labels)%2 != 0 {
+		return nil, errors.E(errors.Invalid, "metric labels must come in pairs")
+	}
+	for i := 0; i < len(labels); i += 2 {
+		if labels[i] == "op" || labels[i] == "kind" || labels[i] == "instance" {
+			return nil, errors.E(errors.Invalid, errors.Errorf("metric label %q is reserved", labels[i]))
+		}
+	}
+	start := time.Now()
+	return &monitoringSaver{
+		projectID:    projectID,
+		staticLabels: mergeMaps(makeLabels(labels), map[string]string{"instance": instance(start)}),
+		period:       period,
+		start:        start,
+		stats:        make(map[opKey]*opStats),
+	}, nil
+}
+
+// instance returns the value of the instance label of a saver started
+// at the given time.
+func instance(start time.Time) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d/%d", host, os.Getpid(), start.Unix())
+}
+
+func (g *monitoringSaver) Register(queue chan *metric.Metric) {
+	g.saverQueue = queue
+	g.writes = make(chan *seriesWrite, 1)
+	g.flushes = make(chan chan struct{})
+	g.closing = make(chan struct{})
+	g.closed = make(chan struct{})
+	go g.saverLoop()
+	go g.writeLoop()
+	shutdown.Handle(g.Close)
+}
+
+// Flush implements BufferedSaver.
+func (g *monitoringSaver) Flush() {
+	if g.flushes == nil {
+		// Not registered.
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case g.flushes <- done:
+		<-done
+	case <-g.closing:
+	}
+}
+
+// Close implements BufferedSaver.
+func (g *monitoringSaver) Close() {
+	if g.closing == nil {
+		// Not registered.
+		return
+	}
+	g.closeOnce.Do(func() { close(g.closing) })
+	<-g.closed
+}
+
+// saverLoop aggregates the metrics read from the queue and, every period,
+// hands the aggregates to writeLoop. The points of a time series must be
+// at least writeSpacing apart, so a tick that follows a write too closely
+// is skipped, and a flush or close that does waits for a timer, while the
+// loop goes on aggregating.
+func (g *monitoringSaver) saverLoop() {
+	ticker := time.NewTicker(g.period)
+	defer ticker.Stop()
+	var (
+		last    time.Time        // The end time of the last points written.
+		spaced  <-chan time.Time // If not nil, fires once a write may follow the last.
+		flushes []chan struct{}  // Flushes waiting for spaced.
+		closing = g.closing      // Nil once Close waits for spaced.
+	)
+	// mayWrite reports whether the aggregates, if there are any, may be
+	// written now. If not, it arranges for spaced to fire once they may.
+	mayWrite := func() bool {
+		if spaced != nil {
+			return false
+		}
+		d := writeSpacing - time.Since(last)
+		if len(g.stats) == 0 || d <= 0 {
+			return true
+		}
+		spaced = time.After(d)
+		return false
+	}
+	// write hands the aggregates, if there are any, to writeLoop.
+	write := func() {
+		if len(g.stats) == 0 {
+			return
+		}
+		last = time.Now()
+		g.writes <- &seriesWrite{series: g.timeSeries(last)}
+	}
+	for {
+		select {
+		case m := <-g.saverQueue:
+			g.aggregate(m)
+		case <-ticker.C:
+			now := time.Now()
+			if len(g.stats) == 0 || spaced != nil || now.Sub(last) < writeSpacing {
+				continue
+			}
+			select {
+			case g.writes <- &seriesWrite{series: g.timeSeries(now)}:
+				last = now
+			default:
+				// The last write is still in progress. As the
+				// values are cumulative, the next will catch up.
+			}
+		case done := <-g.flushes:
+			if !mayWrite() {
+				flushes = append(flushes, done)
+				continue
+			}
+			write()
+			g.writes <- &seriesWrite{done: done}
+		case <-closing:
+			if !mayWrite() {
+				closing = nil
+				continue
+			}
+			write()
+			close(g.writes)
+			return
+		case <-spaced:
+			spaced = nil
+			write()
+			for _, done := range flushes {
+				g.writes <- &seriesWrite{done: done}
+			}
+			flushes = nil
+			if closing == nil {
+				close(g.writes)
+				return
+			}
+		}
+	}
+}
+
+// writeLoop writes the time series sent by saverLoop.
+func (g *monitoringSaver) writeLoop() {
+	defer close(g.closed)
+	for w := range g.writes {
+		if w.done != nil {
+			close(w.done)
+			continue
+		}
+		for len(w.series) > 0 {
+			n := len(w.series)
+			if n > maxSeriesPerWrite {
+				n = maxSeriesPerWrite
+			}
+			err := g.api.Write(&monitoring.CreateTimeSeriesRequest{TimeSeries: w.series[:n]})
+			if err != nil {
+				log.Error.Printf("metric: error saving to GCP: %v", err)
+				saverStats.Add(statFailed, 1)
+			} else {
+				saverStats.Add(statExported, 1)
+			}
+			w.series = w.series[n:]
+		}
+		onFlush()
+	}
+}
+
+// aggregate adds the metric's spans to the aggregates.
+func (g *monitoringSaver) aggregate(m *metric.Metric) {
+	for _, s := range m.Spans() {
+		if s.EndTime.IsZero() {
+			// Never ended.
+			continue
+		}
+		k := opKey{op: s.Name, kind: s.Kind}
+		st, ok := g.stats[k]
+		if !ok {
+			st = new(opStats)
+			g.stats[k] = st
+		}
+		st.requests++
+		if spanerr.Is(s.Annotation) {
+			st.errors++
+		}
+		ms := float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond)
+		st.buckets[latencyBucket(ms)]++
+		// Welford's method.
+		d := ms - st.mean
+		st.mean += d / float64(st.requests)
+		st.sumSq += d * (ms - st.mean)
+	}
+}
+
+// latencyBucket returns the index of the bucket for a latency
+// in milliseconds.
+func latencyBucket(ms float64) int {
+	if ms < latencyScale {
+		return 0
+	}
+	i := int(math.Floor(math.Log(ms/latencyScale)/math.Log(latencyGrowth))) + 1
+	if i > latencyBuckets+1 {
+		i = latencyBuckets + 1
+	}
+	return i
+}
+
+// timeSeries returns the time series of the aggregates at time now,
+// in a stable order.
+func (g *monitoringSaver) timeSeries(now time.Time) []*monitoring.TimeSeries {
+	keys := make([]opKey, 0, len(g.stats))
+	for k := range g.stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	interval := &monitoring.TimeInterval{
+		StartTime: formatTime(g.start),
+		EndTime:   formatTime(now),
+	}
+	resource := &monitoring.MonitoredResource{
+		Type:   "global",
+		Labels: map[string]string{"project_id": g.projectID},
+	}
+	var series []*monitoring.TimeSeries
+	for _, k := range keys {
+		st := g.stats[k]
+		labels := mergeMaps(g.staticLabels, map[string]string{
+			"op":   string(k.op),
+			"kind": strings.ToLower(toSpanKind(k.kind)),
+		})
+		add := func(metricType, valueType, unit string, v *monitoring.TypedValue) {
+			series = append(series, &monitoring.TimeSeries{
+				Metric:     &monitoring.Metric{Type: metricType, Labels: labels},
+				Resource:   resource,
+				MetricKind: "CUMULATIVE",
+				ValueType:  valueType,
+				Unit:       unit,
+				Points:     []*monitoring.Point{{Interval: interval, Value: v}},
+			})
+		}
+		requests, errs := st.requests, st.errors
+		add(requestCountMetric, "INT64", "1", &monitoring.TypedValue{Int64Value: &requests})
+		add(errorCountMetric, "INT64", "1", &monitoring.TypedValue{Int64Value: &errs})
+		add(latencyMetric, "DISTRIBUTION", "ms", &monitoring.TypedValue{
+			DistributionValue: &monitoring.Distribution{
+				Count:                 st.requests,
+				Mean:                  st.mean,
+				SumOfSquaredDeviation: st.sumSq,
+				BucketOptions: &monitoring.BucketOptions{
+					ExponentialBuckets: &monitoring.Exponential{
+						NumFiniteBuckets: latencyBuckets,
+						GrowthFactor:     latencyGrowth,
+						Scale:            latencyScale,
+					},
+				},
+				BucketCounts: append([]int64(nil), st.buckets[:]...),
+			},
+		})
+	}
+	return series
+}
+
+// timeSeriesWriterImpl is a concrete implementation of timeSeriesWriter
+// that writes to GCP.
+type timeSeriesWriterImpl struct {
+	projectID string
+	api       *monitoring.ProjectsTimeSeriesService
+}
+
+var _ timeSeriesWriter = (*timeSeriesWriterImpl)(nil)
+
+// Write implements timeSeriesWriter.
+func (s *timeSeriesWriterImpl) Write(req *monitoring.CreateTimeSeriesRequest) error {
+	_, err := s.api.Create("projects/"+s.projectID, req).Do()
+	return err
+}
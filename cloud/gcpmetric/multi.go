@@ -0,0 +1,62 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcpmetric
+
+import (
+	"upspin.io/metric"
+)
+
+// Multi returns a metric.Saver that hands every metric to each of the
+// savers, so that they may be registered together. Each saver reads from
+// a queue of its own; a metric is dropped for a saver whose queue is full,
+// as metric.Metric.Done does when the registered saver's queue is full.
+// The returned saver implements BufferedSaver, flushing and closing those
+// of the savers that do.
+func Multi(savers ...metric.Saver) metric.Saver {
+	return multiSaver(savers)
+}
+
+type multiSaver []metric.Saver
+
+// Guarantee we implement the BufferedSaver interface.
+var _ BufferedSaver = multiSaver(nil)
+
+func (s multiSaver) Register(queue chan *metric.Metric) {
+	queues := make([]chan *metric.Metric, len(s))
+	for i, saver := range s {
+		queues[i] = make(chan *metric.Metric, metric.SaveQueueLength)
+		saver.Register(queues[i])
+	}
+	go func() {
+		for m := range queue {
+			for _, q := range queues {
+				select {
+				case q <- m:
+				default:
+					saverStats.Add(statDropped, 1)
+				}
+			}
+		}
+	}()
+}
+
+// Flush implements BufferedSaver.
+// Metrics still being handed to the savers may not be flushed.
+func (s multiSaver) Flush() {
+	for _, saver := range s {
+		if b, ok := saver.(BufferedSaver); ok {
+			b.Flush()
+		}
+	}
+}
+
+// Close implements BufferedSaver.
+func (s multiSaver) Close() {
+	for _, saver := range s {
+		if b, ok := saver.(BufferedSaver); ok {
+			b.Close()
+		}
+	}
+}
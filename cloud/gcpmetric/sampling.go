@@ -0,0 +1,92 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcpmetric
+
+import (
+	"hash/fnv"
+	"time"
+
+	"gcp.upspin.io/cloud/spanerr"
+
+	"upspin.io/metric"
+)
+
+// A Sampler decides which metrics are saved. It is consulted once a metric
+// is done and before it is converted for saving.
+type Sampler interface {
+	// Sample reports whether to save the metric, which is saved
+	// in the trace with the given ID.
+	Sample(traceID string, m *metric.Metric) bool
+}
+
+// SamplingSaver is implemented by the metric.Savers of this package,
+// whose sampling may be changed. By default, they sample with
+// HeadSampler(n), where n is the ratio given when they were created.
+type SamplingSaver interface {
+	metric.Saver
+
+	// SetSampler sets the sampler. It must be called before the
+	// saver is registered.
+	SetSampler(Sampler)
+}
+
+// Guarantee we implement the SamplingSaver interface.
+var _ SamplingSaver = (*gcpSaver)(nil)
+
+// SetSampler implements SamplingSaver.
+func (g *gcpSaver) SetSampler(s Sampler) {
+	g.sampler = s
+}
+
+// HeadSampler returns a Sampler that saves 1 in every n traces, chosen by
+// a hash of the trace ID. As each metric is saved in a trace of its own,
+// with a random ID, this saves a random 1 in n metrics. Setting n to 1,
+// or less, saves every trace.
+func HeadSampler(n int) Sampler {
+	if n < 1 {
+		n = 1
+	}
+	return headSampler(n)
+}
+
+type headSampler uint64
+
+func (n headSampler) Sample(traceID string, _ *metric.Metric) bool {
+	if n <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(traceID))
+	return h.Sum64()%uint64(n) == 0
+}
+
+// TailSampler is a Sampler that saves every metric with a span that took
+// at least Latency or that failed, and defers to Head for the others. If
+// Latency is zero, no metric is saved for its latency alone: those that
+// failed are saved and the others are still deferred to Head. If Head is
+// nil, the others are dropped.
+//
+// A span counts as failed only if its annotation was marked by
+// spanerr.Mark. Only the GCS storage backend marks its spans, those of
+// its operations and Cloud Storage calls that fail, so errors elsewhere,
+// such as those a server returns to its client, are sampled like any
+// other span.
+type TailSampler struct {
+	Latency time.Duration
+	Head    Sampler
+}
+
+// Sample implements Sampler.
+func (s TailSampler) Sample(traceID string, m *metric.Metric) bool {
+	for _, span := range m.Spans() {
+		if s.Latency > 0 && span.EndTime.Sub(span.StartTime) >= s.Latency {
+			return true
+		}
+		if spanerr.Is(span.Annotation) {
+			return true
+		}
+	}
+	return s.Head != nil && s.Head.Sample(traceID, m)
+}
@@ -0,0 +1,177 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcpmetric
+
+import (
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	cloudtrace "google.golang.org/api/cloudtrace/v2"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/metric"
+)
+
+// Version 2 of the Cloud Trace API shares its data model with OpenTelemetry:
+// a trace has a 16-byte ID, each span an 8-byte ID unique within the trace
+// and a kind, and spans carry attributes and timestamped annotations, which
+// OpenTelemetry calls events. A metric is converted to a trace in that model,
+// so that it lines up with traces recorded by OpenTelemetry-instrumented
+// programs in the same project. The OpenTelemetry SDK and its exporters are
+// not dependencies of this module, so the spans are written with the Cloud
+// Trace API directly rather than through OTLP.
+
+// spanWriter is an interface to version 2 of the cloudtrace API.
+// It is used mostly for testing.
+type spanWriter interface {
+	// Write writes the spans to GCP.
+	Write(*cloudtrace.BatchWriteSpansRequest) error
+}
+
+// NewSpanSaver returns a metric.Saver that saves metrics to GCP Traces for a
+// GCP projectID, using version 2 of the Cloud Trace API. The caller must have
+// enabled the Cloud Trace API for the projectID and have sufficient
+// permission to use the scope "trace.append".
+//
+// The arguments are as for NewSaver. The static labels are saved as
+// attributes of every span, and a span's annotation as an annotation
+// at the span's end time.
+func NewSpanSaver(projectID string, n, maxQPS int, labels ...string) (metric.Saver, error) {
+	const op errors.Op = "gcpmetric.NewSpanSaver"
+	client, err := google.DefaultClient(context.Background(), cloudtrace.TraceAppendScope)
+	if err != nil {
+		return nil, errors.E(op, errors.Internal, errors.Errorf("unable to get default client: %v", err))
+	}
+	g, err := newGCPSaver(projectID, n, maxQPS, labels)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	srv, err := cloudtrace.New(client)
+	if err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	}
+	g.spans = &spanWriterImpl{
+		projectID: projectID,
+		api:       srv.Projects.Traces,
+	}
+	return g, nil
+}
+
+// prepareSpans converts the metric to spans of the trace with the given
+// ID, for version 2 of the Cloud Trace API.
+func (g *gcpSaver) prepareSpans(m *metric.Metric, traceID string) []*cloudtrace.Span {
+	spans := m.Spans()
+	ids := makeSpanIDs(len(spans))
+	out := make([]*cloudtrace.Span, len(spans))
+	for i, s := range spans {
+		out[i] = &cloudtrace.Span{
+			Name:        fmt.Sprintf("projects/%s/traces/%s/spans/%s", g.projectID, traceID, ids[i]),
+			SpanId:      ids[i],
+			DisplayName: truncatable(string(s.Name), 128),
+			StartTime:   formatTime(s.StartTime),
+			EndTime:     formatTime(s.EndTime),
+			SpanKind:    toSpanKind(s.Kind),
+			Attributes:  toAttributes(g.staticLabels),
+		}
+		if s.Annotation != "" {
+			out[i].TimeEvents = &cloudtrace.TimeEvents{
+				TimeEvent: []*cloudtrace.TimeEvent{{
+					Time: formatTime(s.EndTime),
+					Annotation: &cloudtrace.Annotation{
+						Description: truncatable(s.Annotation, 256),
+					},
+				}},
+			}
+		}
+		if s.ParentSpan != nil {
+			if r := findSpanRank(s.ParentSpan, m); r != -1 {
+				out[i].ParentSpanId = ids[r]
+				out[i].SameProcessAsParentSpan = true
+			}
+		}
+	}
+	return out
+}
+
+func (g *gcpSaver) saveSpans(spans []*cloudtrace.Span) error {
+	err := g.spans.Write(&cloudtrace.BatchWriteSpansRequest{
+		Spans: spans,
+	})
+	if err != nil {
+		log.Error.Printf("metric: error saving to GCP: %v", err)
+	}
+	onFlush()
+	return err
+}
+
+// toSpanKind returns the OpenTelemetry span kind of k.
+func toSpanKind(k metric.Kind) string {
+	switch k {
+	case metric.Server:
+		return "SERVER"
+	case metric.Client:
+		return "CLIENT"
+	default:
+		return "INTERNAL"
+	}
+}
+
+// toAttributes converts labels to span attributes.
+// It returns nil if there are no labels.
+func toAttributes(labels map[string]string) *cloudtrace.Attributes {
+	if len(labels) == 0 {
+		return nil
+	}
+	a := &cloudtrace.Attributes{
+		AttributeMap: make(map[string]cloudtrace.AttributeValue, len(labels)),
+	}
+	for k, v := range labels {
+		a.AttributeMap[k] = cloudtrace.AttributeValue{StringValue: truncatable(v, 256)}
+	}
+	return a
+}
+
+// truncatable returns s as a TruncatableString of at most max bytes.
+func truncatable(s string, max int) *cloudtrace.TruncatableString {
+	t := &cloudtrace.TruncatableString{Value: s}
+	if len(s) > max {
+		t.Value = s[:max]
+		t.TruncatedByteCount = int64(len(s) - max)
+	}
+	return t
+}
+
+// makeSpanIDs makes n distinct random span IDs of 8 bytes of hex-encoded
+// digits, none of them zero, as GCP Traces expects.
+func makeSpanIDs(n int) []string {
+	ids := make([]string, n)
+	seen := make(map[uint64]bool, n)
+	for i := range ids {
+		id := rand.Uint64()
+		for id == 0 || seen[id] {
+			id = rand.Uint64()
+		}
+		seen[id] = true
+		ids[i] = fmt.Sprintf("%016x", id)
+	}
+	return ids
+}
+
+// spanWriterImpl is a concrete implementation of spanWriter that writes to GCP.
+type spanWriterImpl struct {
+	projectID string
+	api       *cloudtrace.ProjectsTracesService
+}
+
+var _ spanWriter = (*spanWriterImpl)(nil)
+
+// Write implements spanWriter.
+func (s *spanWriterImpl) Write(req *cloudtrace.BatchWriteSpansRequest) error {
+	_, err := s.api.BatchWrite("projects/"+s.projectID, req).Do()
+	return err
+}
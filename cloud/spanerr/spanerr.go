@@ -0,0 +1,28 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spanerr marks the annotations of metric spans that failed. Code
+// that records spans, such as the GCS storage backend, marks them with Mark,
+// and the savers of package gcpmetric recognize them with Is, without either
+// depending on the other.
+package spanerr // import "gcp.upspin.io/cloud/spanerr"
+
+import "strings"
+
+// Marker is the last word of the annotation of a span that failed.
+const Marker = "error"
+
+// Mark returns the span annotation marked as that of a failed span.
+func Mark(annotation string) string {
+	if annotation == "" {
+		return Marker
+	}
+	return annotation + " " + Marker
+}
+
+// Is reports whether the span annotation marks a failed span.
+func Is(annotation string) bool {
+	f := strings.Fields(annotation)
+	return len(f) > 0 && f[len(f)-1] == Marker
+}
@@ -0,0 +1,288 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package diskcache implements a size-bounded cache of immutable data
+// in a local directory, evicting the least recently used entries.
+// It is intended for caching Upspin blocks, which never change once
+// written, so entries need never be invalidated, only removed.
+package diskcache // import "gcp.upspin.io/cloud/storage/diskcache"
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Cache is an on-disk cache of data keyed by ref.
+// It is safe for concurrent use.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64                    // Total size of the cached files.
+	lru     *list.List               // Of *entry, most recently used first.
+	entries map[string]*list.Element // Keyed by file name.
+}
+
+// entry is a cached file.
+type entry struct {
+	name string // The file's name, relative to dir.
+	size int64
+}
+
+// New returns a cache that stores at most maxSize bytes in dir, creating
+// dir if necessary. Entries left in dir by an earlier Cache are kept, and
+// the least recently used of them evicted if they exceed maxSize.
+func New(dir string, maxSize int64) (*Cache, error) {
+	const op errors.Op = "cloud/storage/diskcache.New"
+	if maxSize <= 0 {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("cache size %d is not positive", maxSize))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	}
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	if err := c.load(); err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	}
+	return c, nil
+}
+
+// load adds the files in the cache directory to the cache, treating those
+// modified most recently as most recently used. Temporary files left by an
+// interrupted Put are removed.
+func (c *Cache) load() error {
+	type file struct {
+		entry
+		mtime time.Time
+	}
+	var files []file
+	err := filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		if filepath.Base(name)[0] == '.' {
+			return os.Remove(path)
+		}
+		files = append(files, file{entry{name, fi.Size()}, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.After(files[j].mtime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		e := f.entry
+		c.entries[e.name] = c.lru.PushBack(&e)
+		c.size += e.size
+	}
+	c.evict()
+	return nil
+}
+
+// fileName returns the name of the file that caches ref. Refs are hashed
+// so that any ref, whatever its length or characters, makes a valid name.
+// Files are spread over 256 subdirectories to keep directories small.
+func fileName(ref string) string {
+	sum := sha256.Sum256([]byte(ref))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(h[:2], h[2:])
+}
+
+// use marks the named file as most recently used and reports whether it
+// is in the cache.
+func (c *Cache) use(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	return ok
+}
+
+// Get returns the data cached for ref, and whether it was present.
+func (c *Cache) Get(ref string) ([]byte, bool) {
+	name := fileName(ref)
+	if !c.use(name) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		// Evicted since we looked, or damaged.
+		c.remove(name, err)
+		return nil, false
+	}
+	c.touch(name)
+	return data, true
+}
+
+// open returns the file that caches ref and its size,
+// and whether it was present. The caller must close the file.
+func (c *Cache) open(ref string) (f *os.File, size int64, ok bool) {
+	name := fileName(ref)
+	if !c.use(name) {
+		return nil, 0, false
+	}
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			c.touch(name)
+			return f, fi.Size(), true
+		}
+		f.Close()
+	}
+	c.remove(name, err)
+	return nil, 0, false
+}
+
+// touch records the use of the named file in its modification time,
+// so that the order of use survives a restart.
+func (c *Cache) touch(name string) {
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, name), now, now)
+}
+
+// Put caches data for ref, evicting the least recently used entries as
+// necessary to make room for it. Data larger than the cache is not cached.
+func (c *Cache) Put(ref string, data []byte) error {
+	const op errors.Op = "cloud/storage/diskcache.Put"
+	size := int64(len(data))
+	if size > c.maxSize {
+		return nil
+	}
+	name := fileName(ref)
+	path := filepath.Join(c.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+	// Write to a temporary file and rename it into place,
+	// so that readers never see a partial file.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".put")
+	if err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.E(op, errors.IO, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		// Another Put of the same ref won the race.
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+	}
+	c.entries[name] = c.lru.PushFront(&entry{name, size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// Delete removes any data cached for ref.
+func (c *Cache) Delete(ref string) {
+	c.remove(fileName(ref), nil)
+}
+
+// remove removes the named file from the cache.
+// If err is not nil, it explains why and is logged.
+func (c *Cache) remove(name string, err error) {
+	if err != nil && !os.IsNotExist(err) {
+		log.Error.Printf("cloud/storage/diskcache: removing %s: %v", name, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, name)
+	c.size -= el.Value.(*entry).size
+	os.Remove(filepath.Join(c.dir, name))
+}
+
+// evict removes the least recently used files
+// until the cache is no larger than its maximum size.
+// It must be called with c.mu held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		e := el.Value.(*entry)
+		c.lru.Remove(el)
+		delete(c.entries, e.name)
+		c.size -= e.size
+		if err := os.Remove(filepath.Join(c.dir, e.name)); err != nil && !os.IsNotExist(err) {
+			log.Error.Printf("cloud/storage/diskcache: evicting %s: %v", e.name, err)
+		}
+	}
+}
+
+// Size returns the total size of the cached data.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// sectionReadCloser is an io.ReadCloser for a section of a file.
+type sectionReadCloser struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s sectionReadCloser) Close() error { return s.f.Close() }
+
+// OpenRange returns a reader for length bytes of the data cached for ref
+// starting at offset, or for the rest of the data if length is negative,
+// and whether it was present. If it was present but offset is beyond its
+// end, OpenRange returns an errors.Invalid. The caller must close the
+// reader.
+func (c *Cache) OpenRange(ref string, offset, length int64) (io.ReadCloser, bool, error) {
+	const op errors.Op = "cloud/storage/diskcache.OpenRange"
+	f, size, ok := c.open(ref)
+	if !ok {
+		return nil, false, nil
+	}
+	if offset < 0 || offset > size {
+		f.Close()
+		return nil, true, errors.E(op, errors.Invalid, errors.Errorf("offset %d out of range for %q of size %d", offset, ref, size))
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return sectionReadCloser{io.NewSectionReader(f, offset, length), f}, true, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskcache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i)}, 10) }
+	ref := func(i int) string { return fmt.Sprintf("ref/%d", i) }
+
+	if _, ok := c.Get(ref(0)); ok {
+		t.Fatal("Get of empty cache succeeded")
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Put(ref(i), data(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Use ref 0 so that ref 1 is the least recently used.
+	if got, ok := c.Get(ref(0)); !ok || !bytes.Equal(got, data(0)) {
+		t.Fatalf("Get(%q) = %q, %v; want %q, true", ref(0), got, ok, data(0))
+	}
+	if err := c.Put(ref(3), data(3)); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := c.Get(ref(i)); ok != want {
+			t.Errorf("after eviction, Get(%q) present = %v, want %v", ref(i), ok, want)
+		}
+	}
+	if got, want := c.Size(), int64(30); got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+
+	rc, ok, err := c.OpenRange(ref(3), 2, 5)
+	if !ok || err != nil {
+		t.Fatalf("OpenRange(%q): present = %v, error %v", ref(3), ok, err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := data(3)[2:7]; !bytes.Equal(got, want) {
+		t.Errorf("OpenRange(%q, 2, 5) read %q, want %q", ref(3), got, want)
+	}
+	if _, _, err := c.OpenRange(ref(3), 11, 1); !errors.Is(errors.Invalid, err) {
+		t.Errorf("OpenRange(%q, 11, 1): got error %v, want Invalid", ref(3), err)
+	}
+
+	c.Delete(ref(3))
+	if _, ok := c.Get(ref(3)); ok {
+		t.Errorf("Get(%q) succeeded after Delete", ref(3))
+	}
+
+	// Data larger than the cache is not cached.
+	if err := c.Put("big", make([]byte, 31)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("big"); ok {
+		t.Error("data larger than the cache was cached")
+	}
+
+	// A new cache in the same directory keeps the entries,
+	// and removes temporary files.
+	tmp := filepath.Join(dir, ".put123")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err = New(dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2} {
+		if got, ok := c.Get(ref(i)); !ok || !bytes.Equal(got, data(i)) {
+			t.Errorf("after reopening, Get(%q) = %q, %v; want %q, true", ref(i), got, ok, data(i))
+		}
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temporary file not removed: %v", err)
+	}
+
+	// A smaller cache evicts entries on reopening.
+	c, err = New(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Size(), int64(10); got != want {
+		t.Errorf("after reopening smaller, Size() = %d, want %d", got, want)
+	}
+}
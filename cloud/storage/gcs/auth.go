@@ -0,0 +1,130 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+
+	"upspin.io/errors"
+)
+
+// Keys used for storing the authentication options.
+// At most one of privateKeyData, credentialsFile and externalAccountData
+// may be set. If none is, the backend authenticates with the application
+// default credentials, such as those of the service account the server
+// runs as on Compute Engine or is bound to by GKE Workload Identity.
+const (
+	// credentialsFile, if set, is the name of a JSON credentials file,
+	// such as a service account key or an external account configuration,
+	// with which the backend authenticates.
+	credentialsFile = "gcpCredentialsFile"
+
+	// externalAccountData, if set, is a base64-encoded external account
+	// configuration, as made by
+	//	gcloud iam workload-identity-pools create-cred-config
+	// with which the backend authenticates through workload identity
+	// federation, without a service account key.
+	externalAccountData = "externalAccountData"
+
+	// impersonateServiceAccount, if set, is the email address of a service
+	// account that the backend impersonates. The credentials otherwise in
+	// use must have the Service Account Token Creator role on it, or on the
+	// first of the impersonateDelegates. The impersonated account also
+	// signs URLs if signedURLExpiry is set.
+	impersonateServiceAccount = "impersonateServiceAccount"
+
+	// impersonateDelegates is a comma-separated list of the service accounts
+	// in the delegation chain through which impersonateServiceAccount is
+	// impersonated, each of which must have the Service Account Token
+	// Creator role on the next.
+	impersonateDelegates = "impersonateDelegates"
+)
+
+// credentials returns the client options with which the backend described
+// by opts authenticates, and the service account that signs URLs if it
+// cannot be found from the credentials. If noAuth is set and opts request
+// no particular credentials, requests are not authenticated.
+func credentials(ctx context.Context, opts map[string]string, noAuth bool) (clientOpts []option.ClientOption, signer string, err error) {
+	var creds []byte
+	set := 0
+	for _, k := range []string{privateKeyData, credentialsFile, externalAccountData} {
+		v, ok := opts[k]
+		if !ok {
+			continue
+		}
+		set++
+		switch k {
+		case privateKeyData:
+			creds, err = base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, "", errors.E(errors.IO, errors.Errorf("unable to decode %s: %s", privateKeyData, err))
+			}
+		case credentialsFile:
+			creds, err = ioutil.ReadFile(v)
+			if err != nil {
+				return nil, "", errors.E(errors.IO, errors.Errorf("unable to read %s: %s", credentialsFile, err))
+			}
+		case externalAccountData:
+			creds, err = base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, "", errors.E(errors.IO, errors.Errorf("unable to decode %s: %s", externalAccountData, err))
+			}
+			var cfg struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(creds, &cfg); err != nil || cfg.Type != "external_account" {
+				return nil, "", errors.E(errors.Invalid, errors.Errorf("%s is not an external account configuration", externalAccountData))
+			}
+		}
+	}
+	if set > 1 {
+		return nil, "", errors.E(errors.Invalid, errors.Errorf("at most one of %s, %s and %s may be set",
+			privateKeyData, credentialsFile, externalAccountData))
+	}
+	if creds != nil {
+		c, err := google.CredentialsFromJSON(ctx, creds, scope)
+		if err != nil {
+			return nil, "", errors.E(errors.Invalid, err)
+		}
+		clientOpts = append(clientOpts, option.WithCredentials(c))
+	}
+
+	target, ok := opts[impersonateServiceAccount]
+	if !ok {
+		if _, ok := opts[impersonateDelegates]; ok {
+			return nil, "", errors.E(errors.Invalid, errors.Errorf("%s requires %s", impersonateDelegates, impersonateServiceAccount))
+		}
+		if creds == nil && noAuth {
+			clientOpts = append(clientOpts, option.WithoutAuthentication())
+		}
+		return clientOpts, "", nil
+	}
+	if target == "" {
+		return nil, "", errors.E(errors.Invalid, errors.Errorf("empty %s", impersonateServiceAccount))
+	}
+	var delegates []string
+	if v := opts[impersonateDelegates]; v != "" {
+		for _, d := range strings.Split(v, ",") {
+			delegates = append(delegates, strings.TrimSpace(d))
+		}
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Scopes:          []string{scope},
+		Delegates:       delegates,
+	}, clientOpts...)
+	if err != nil {
+		return nil, "", errors.E(errors.Invalid, errors.Errorf("impersonating %s: %v", target, err))
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, target, nil
+}
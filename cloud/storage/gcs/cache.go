@@ -0,0 +1,115 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"expvar"
+	"io/ioutil"
+	"strconv"
+
+	"gcp.upspin.io/cloud/storage/diskcache"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Keys used for storing the cache options.
+const (
+	// cacheDir, if set, is a local directory in which downloaded data is
+	// cached. As refs name immutable data, cached data is never stale.
+	// The data is stored as downloaded, unencrypted by any kmsKeyName,
+	// so the directory should be no more widely readable than the data.
+	// It cannot be set with encryptionKey, which is meant to keep data
+	// readable only by holders of the key.
+	cacheDir = "cacheDir"
+
+	// cacheSize is the maximum number of bytes stored in cacheDir.
+	// The least recently used data is evicted to stay within it.
+	cacheSize = "cacheSize"
+)
+
+// defaultCacheSize is the cache size used when cacheDir is set
+// but cacheSize is not.
+const defaultCacheSize = 1 << 30
+
+// cacheStats holds counters of cache use, published as the expvar
+// "cloud/storage/gcs.cache". They are shared by all backends.
+var cacheStats = expvar.NewMap("cloud/storage/gcs.cache")
+
+// Names of the counters in cacheStats.
+const (
+	cacheHits   = "hits"   // Reads served from the cache.
+	cacheMisses = "misses" // Reads served from Cloud Storage.
+	cacheErrors = "errors" // Failures to store data in the cache.
+)
+
+// newCache returns the cache described by opts, or nil if there is none.
+func newCache(opts map[string]string) (*diskcache.Cache, error) {
+	dir, ok := opts[cacheDir]
+	if !ok {
+		return nil, nil
+	}
+	size := int64(defaultCacheSize)
+	if v, ok := opts[cacheSize]; ok {
+		var err error
+		size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, errors.E(errors.Invalid, errors.Errorf("invalid %s %q", cacheSize, v))
+		}
+	}
+	return diskcache.New(dir, size)
+}
+
+// cachePut stores data for ref in the cache, if there is one.
+// Failures are counted, but are otherwise harmless.
+func (gcs *gcsImpl) cachePut(ref string, data []byte) {
+	if gcs.cache == nil {
+		return
+	}
+	if err := gcs.cache.Put(ref, data); err != nil {
+		log.Error.Printf("cloud/storage/gcs: caching %q: %v", ref, err)
+		cacheStats.Add(cacheErrors, 1)
+	}
+}
+
+// coldClasses are the storage classes whose reads are charged
+// by the byte retrieved.
+var coldClasses = map[string]bool{
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+}
+
+// downloadCold downloads and caches the whole of ref if it is in a cold
+// storage class, and reports whether it did. The caller must have found
+// that ref is not in the cache.
+func (gcs *gcsImpl) downloadCold(ref string) (_ []byte, ok bool, err error) {
+	const op errors.Op = "cloud/storage/gcs.downloadCold"
+	ctx, cancel := gcs.opContext(gcs.timeouts.download)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endDownload(span, err) }()
+	callCtx, call := gcs.startCall(ctx, "Get", ref)
+	call.missingOK = true
+	attrs, err := gcs.object(callCtx, ref).Attrs(callCtx)
+	call.end(err)
+	if err != nil {
+		return nil, false, toUpspinError(op, err)
+	}
+	if !coldClasses[attrs.StorageClass] {
+		return nil, false, nil
+	}
+	rc, err := gcs.download(ctx, ref, 0, -1)
+	if err != nil {
+		return nil, false, toUpspinError(op, err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, false, toUpspinError(op, err)
+	}
+	gcs.cachePut(ref, data)
+	return data, true, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	gcsBE "cloud.google.com/go/storage"
+
+	"upspin.io/errors"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksums is an io.Writer that computes the CRC32C and MD5 checksums of
+// the data written to it, in the base64 encoding used by Cloud Storage,
+// and counts its bytes.
+type checksums struct {
+	crc32c hash.Hash32
+	md5    hash.Hash
+	size   int64
+}
+
+func newChecksums() *checksums {
+	return &checksums{
+		crc32c: crc32.New(crc32cTable),
+		md5:    md5.New(),
+	}
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	c.crc32c.Write(p)
+	c.md5.Write(p)
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// CRC32C returns the base64-encoded big-endian CRC32C checksum.
+func (c *checksums) CRC32C() string {
+	return encodeCRC32C(c.crc32c.Sum32())
+}
+
+// MD5 returns the base64-encoded MD5 hash.
+func (c *checksums) MD5() string {
+	return base64.StdEncoding.EncodeToString(c.md5.Sum(nil))
+}
+
+// verify checks the computed checksums against those reported by Cloud
+// Storage for ref. Checksums that were not reported are not checked.
+func (c *checksums) verify(ref, crc32c, md5 string) error {
+	if got := c.CRC32C(); crc32c != "" && got != crc32c {
+		return errors.E(errors.IO, errors.Errorf("CRC32C mismatch for %q: computed %s, stored %s", ref, got, crc32c))
+	}
+	if got := c.MD5(); md5 != "" && got != md5 {
+		return errors.E(errors.IO, errors.Errorf("MD5 mismatch for %q: computed %s, stored %s", ref, got, md5))
+	}
+	return nil
+}
+
+// encodeCRC32C returns the base64 encoding of a big-endian
+// CRC32C checksum, as used by Cloud Storage.
+func encodeCRC32C(sum uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], sum)
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// encodeMD5 returns the base64 encoding of an MD5 hash,
+// or the empty string if there is no hash.
+func encodeMD5(sum []byte) string {
+	if len(sum) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// verifyingReader reads a whole object and, on reaching its end, checks
+// the data read against the CRC32C and MD5 checksums stored with the
+// object, reporting a mismatch as an errors.IO. The client library also
+// checks the CRC32C checksum and fails the last read if it does not match;
+// that failure is reported as an errors.IO only if the data read is the
+// size of the object and does not match its checksums. Objects stored
+// with a Content-Encoding of gzip are not checked, as Cloud Storage may
+// serve them decompressed.
+type verifyingReader struct {
+	*gcsBE.Reader
+	ref     string
+	attrs   func() (*gcsBE.ObjectAttrs, error) // Returns the object's stored attributes.
+	sums    *checksums
+	checked bool
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	v.sums.Write(p[:n])
+	if err == nil || v.checked {
+		return n, err
+	}
+	v.checked = true
+	attrs, aerr := v.attrs()
+	switch {
+	case aerr != nil:
+		if err == io.EOF {
+			err = aerr
+		}
+	case attrs.ContentEncoding == "gzip":
+		// The stored checksums are of the compressed data.
+	case v.sums.size != attrs.Size:
+		if err == io.EOF {
+			err = errors.E(errors.IO, errors.Errorf("reading %q: got %d bytes, want %d", v.ref, v.sums.size, attrs.Size))
+		}
+	default:
+		crc32c := ""
+		if attrs.CRC32C != 0 {
+			crc32c = encodeCRC32C(attrs.CRC32C)
+		}
+		if verr := v.sums.verify(v.ref, crc32c, encodeMD5(attrs.MD5)); verr != nil {
+			err = verr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,244 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"sync"
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// DrainOptions controls the draining of a bucket by Drain.
+type DrainOptions struct {
+	// Confirm must be the name of the bucket being drained,
+	// as a guard against draining the wrong one.
+	Confirm string
+
+	// Concurrency is the number of objects deleted at once.
+	// If it is zero, 10 objects are deleted at once.
+	Concurrency int
+
+	// QPS, if positive, limits the rate at which objects are deleted,
+	// in deletions per second. A rate of a billion or more, beyond the
+	// resolution of the limiter, is no limit.
+	QPS float64
+
+	// Retries is the number of further attempts made to delete objects
+	// that could not be deleted, and to list the bucket when listing
+	// fails. If it is zero, 3 attempts are made.
+	Retries int
+
+	// Progress, if not nil, is called after each page of objects is
+	// deleted and after each further attempt to delete objects.
+	Progress func(DrainProgress)
+}
+
+// DrainProgress reports the progress of Drain.
+// In a bucket with object versioning, each version of an object
+// is counted as an object.
+type DrainProgress struct {
+	Listed  int64 // Objects listed so far.
+	Deleted int64 // Objects deleted so far.
+	Failed  int64 // Objects that could not yet be deleted.
+}
+
+// Drainer is implemented by storage backends that can remove
+// all the data they store.
+type Drainer interface {
+	// Drain permanently deletes every object stored by the backend,
+	// including any noncurrent versions of objects.
+	// It is an expensive and dangerous operation, so use with care.
+	Drain(opts DrainOptions) error
+}
+
+// Guarantee we implement the Drainer interface.
+var _ Drainer = (*gcsImpl)(nil)
+
+// drainRetryDelay is the delay before the first retry by Drain.
+// It doubles with each retry. It is a variable so that tests may
+// change it.
+var drainRetryDelay = time.Second
+
+// Drain implements Drainer.
+// If the backend has an object prefix, only objects under it are deleted.
+// Objects are listed a page at a time and the page deleted in parallel
+// before the next is listed. Each version of an object is listed and
+// deleted by its generation, so that a bucket with object versioning is
+// left empty rather than holding noncurrent versions. Objects that cannot
+// be deleted are retried after the whole bucket has been listed.
+func (gcs *gcsImpl) Drain(opts DrainOptions) error {
+	const op errors.Op = "cloud/storage/gcs.Drain"
+	if opts.Confirm != gcs.bucketName {
+		return errors.E(op, errors.Invalid, errors.Errorf("confirmation %q does not match bucket %q", opts.Confirm, gcs.bucketName))
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 10
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	d := &drainer{gcs: gcs, opts: opts}
+	if opts.QPS > 0 && opts.QPS < 1e9 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / opts.QPS))
+		defer t.Stop()
+		d.tick = t.C
+	}
+
+	var listErr error
+	token := ""
+	for {
+		var objs []*gcsBE.ObjectAttrs
+		var next string
+		err := d.retry(func() error {
+			ctx, cancel := gcs.opContext(gcs.timeouts.list)
+			defer cancel()
+			var err error
+			objs, next, err = gcs.listPage(ctx, gcsBE.Query{Versions: true}, maxResults, token, "Name", "Generation")
+			return err
+		})
+		if err != nil {
+			// Retry the failed deletions before giving up.
+			listErr = toUpspinError(op, err)
+			break
+		}
+		versions := make([]version, len(objs))
+		for i, o := range objs {
+			versions[i] = version{o.Name, o.Generation}
+		}
+		d.mu.Lock()
+		d.progress.Listed += int64(len(versions))
+		d.mu.Unlock()
+		d.deleteAll(versions)
+		d.report()
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	delay := drainRetryDelay
+	for i := 0; i < opts.Retries && len(d.failed) > 0; i++ {
+		time.Sleep(delay)
+		delay *= 2
+		versions := d.failed
+		d.failed = nil
+		d.progress.Failed = 0
+		d.deleteAll(versions)
+		d.report()
+	}
+
+	if listErr != nil {
+		return listErr
+	}
+	if len(d.failed) > 0 {
+		return errors.E(op, errors.IO, errors.Errorf("%d objects could not be deleted; first error: %v", len(d.failed), d.firstErr))
+	}
+	return nil
+}
+
+// drainer holds the state of a call to Drain.
+type drainer struct {
+	gcs  *gcsImpl
+	opts DrainOptions
+	tick <-chan time.Time // Limits the rate of deletions; nil if unlimited.
+
+	mu       sync.Mutex // Protects the fields below.
+	progress DrainProgress
+	failed   []version // Versions that could not be deleted.
+	firstErr error     // The first error deleting a version.
+}
+
+// version identifies a version of the object that stores ref.
+type version struct {
+	ref string
+	gen int64
+}
+
+// deleteAll deletes the versions, opts.Concurrency at a time,
+// recording those that could not be deleted.
+func (d *drainer) deleteAll(versions []version) {
+	work := make(chan version)
+	var wg sync.WaitGroup
+	for i := 0; i < d.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range work {
+				if d.tick != nil {
+					<-d.tick
+				}
+				err := d.delete(v)
+				if errors.Is(errors.NotExist, err) {
+					// Someone else deleted it.
+					err = nil
+				}
+				d.mu.Lock()
+				if err == nil {
+					d.progress.Deleted++
+				} else {
+					log.Error.Printf("cloud/storage/gcs: Drain: deleting %q generation %d: %v", v.ref, v.gen, err)
+					d.progress.Failed++
+					d.failed = append(d.failed, v)
+					if d.firstErr == nil {
+						d.firstErr = err
+					}
+				}
+				d.mu.Unlock()
+			}
+		}()
+	}
+	for _, v := range versions {
+		work <- v
+	}
+	close(work)
+	wg.Wait()
+}
+
+// delete permanently deletes the version.
+func (d *drainer) delete(v version) (err error) {
+	const op errors.Op = "cloud/storage/gcs.Drain"
+	gcs := d.gcs
+	ctx, cancel := gcs.opContext(gcs.timeouts.delete)
+	defer cancel()
+	if gcs.cache != nil {
+		gcs.cache.Delete(v.ref)
+	}
+	ctx, call := gcs.startCall(ctx, "Delete", v.ref)
+	err = gcs.object(ctx, v.ref).Generation(v.gen).Delete(ctx)
+	call.end(err)
+	if err != nil {
+		return toUpspinError(op, err)
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, making at most opts.Retries further
+// attempts, and returns its last error.
+func (d *drainer) retry(f func() error) error {
+	delay := drainRetryDelay
+	err := f()
+	for i := 0; i < d.opts.Retries && err != nil; i++ {
+		log.Error.Printf("cloud/storage/gcs: Drain: listing %q: %v; retrying", d.gcs.bucketName, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = f()
+	}
+	return err
+}
+
+// report reports the progress of the drain.
+func (d *drainer) report() {
+	if d.opts.Progress == nil {
+		return
+	}
+	d.mu.Lock()
+	p := d.progress
+	d.mu.Unlock()
+	d.opts.Progress(p)
+}
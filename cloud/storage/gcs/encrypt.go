@@ -0,0 +1,59 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"encoding/base64"
+
+	"upspin.io/errors"
+)
+
+// Keys used for storing the encryption options.
+// At most one of them may be set. If neither is set, objects are encrypted
+// with the bucket's default key, which is managed by Google unless the
+// bucket is configured otherwise.
+const (
+	// kmsKeyName is the resource name of a Cloud KMS key with which
+	// objects are encrypted (a customer-managed encryption key), of the
+	// form projects/P/locations/L/keyRings/R/cryptoKeys/K.
+	// The bucket's Cloud Storage service agent must be permitted to use
+	// the key. Reads need no configuration, as Cloud Storage records
+	// which key encrypted each object.
+	kmsKeyName = "kmsKeyName"
+
+	// encryptionKey is a standard base64-encoded 256-bit AES key with
+	// which objects are encrypted (a customer-supplied encryption key).
+	// Cloud Storage does not keep the key, so it must be supplied to
+	// read the objects back and objects cannot be downloaded directly
+	// from the bucket.
+	encryptionKey = "encryptionKey"
+)
+
+// newEncryption returns the customer-supplied key or the name of the Cloud
+// KMS key described by opts. Both are empty if objects use the bucket's
+// default encryption.
+func newEncryption(opts map[string]string) (key []byte, kmsKey string, err error) {
+	keyData, hasKey := opts[encryptionKey]
+	kmsKey, hasKMSKey := opts[kmsKeyName]
+	switch {
+	case hasKey && hasKMSKey:
+		return nil, "", errors.E(errors.Invalid, errors.Errorf("only one of %s and %s may be set", encryptionKey, kmsKeyName))
+	case hasKMSKey:
+		if kmsKey == "" {
+			return nil, "", errors.E(errors.Invalid, errors.Errorf("empty %s", kmsKeyName))
+		}
+		return nil, kmsKey, nil
+	case hasKey:
+		key, err := base64.StdEncoding.DecodeString(keyData)
+		if err != nil {
+			return nil, "", errors.E(errors.Invalid, errors.Errorf("unable to decode %s: %s", encryptionKey, err))
+		}
+		if len(key) != 32 {
+			return nil, "", errors.E(errors.Invalid, errors.Errorf("%s is %d bytes long, want 32", encryptionKey, len(key)))
+		}
+		return key, "", nil
+	}
+	return nil, "", nil
+}
@@ -6,27 +6,29 @@
 package gcs // import "gcp.upspin.io/cloud/storage/gcs"
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/md5"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
-	"net/http"
 	"strings"
 	"time"
 
-	gContext "golang.org/x/net/context"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/googleapi"
-	gcsBE "google.golang.org/api/storage/v1"
+	gcsBE "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"gcp.upspin.io/cloud/storage/diskcache"
 
 	"upspin.io/cloud/storage"
 	"upspin.io/errors"
 	"upspin.io/log"
+	"upspin.io/shutdown"
 	"upspin.io/upspin"
 )
 
 const (
-	scope = gcsBE.DevstorageFullControlScope
+	scope = gcsBE.ScopeFullControl
 )
 
 // These constants define ACLs for writing data to Google Cloud Store.
@@ -42,6 +44,12 @@ const (
 	ProjectPrivate = "projectPrivate"
 	// BucketOwnerFullCtrl means the object owner gets owner access and project team owners get owner access.
 	BucketOwnerFullCtrl = "bucketOwnerFullControl"
+	// Uniform means no ACL is set on objects and access is governed by the
+	// bucket's IAM policy. It is required for buckets with uniform
+	// bucket-level access enabled.
+	Uniform = "uniform"
+	// NoACL is a synonym for Uniform.
+	NoACL = "none"
 )
 
 // Keys used for storing dial options.
@@ -49,14 +57,59 @@ const (
 	bucketName     = "gcpBucketName"
 	defaultACL     = "defaultACL"
 	privateKeyData = "privateKeyData"
+
+	// gcpEndpoint, if set, is the base URL of a server that implements
+	// the Cloud Storage JSON API, such as an emulator or the fake in
+	// package gcstest. Unless privateKeyData is also set, requests to
+	// the endpoint are not authenticated.
+	gcpEndpoint = "gcpEndpoint"
+
+	// objectPrefix, if set, is prepended to the name of every object
+	// the backend stores, so that several Upspin installations may share
+	// a bucket. It typically ends in a slash.
+	objectPrefix = "gcpObjectPrefix"
+
+	// storageClass, if set, is the storage class in which objects are
+	// created, overriding the bucket's default. It is one of STANDARD,
+	// NEARLINE, COLDLINE and ARCHIVE. Objects in the colder classes,
+	// whether created in them or moved there by lifecycle rules, are
+	// read as usual, but each read is charged by the byte retrieved and
+	// objects deleted soon after they are created incur early deletion
+	// charges. If the backend has a cache, reads of ranges of cold
+	// objects fill it with the whole object; see DownloadRange.
+	storageClass = "storageClass"
 )
 
+// storageClasses are the valid values of the storageClass option.
+var storageClasses = map[string]bool{
+	"STANDARD": true,
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+}
+
 // gcsImpl is an implementation of Storage that connects to a Google Cloud Storage (GCS) backend.
 type gcsImpl struct {
-	client          *http.Client
-	service         *gcsBE.Service
+	client          *gcsBE.Client
+	bucket          *gcsBE.BucketHandle
 	bucketName      string
+	prefix          string // Prepended to refs to form object names.
 	defaultWriteACL string
+	retry           *retryPolicy
+	timeouts        *timeouts
+	linkExpiry      time.Duration    // Lifetime of signed URLs; zero if URLs are not signed.
+	signer          string           // Service account that signs URLs, if not found from the credentials.
+	encryptionKey   []byte           // Customer-supplied encryption key, if any.
+	kmsKeyName      string           // Cloud KMS key that encrypts new objects, if any.
+	storageClass    string           // Storage class of new objects; empty for the bucket's default.
+	keepDeleted     bool             // Whether deleted objects are kept as noncurrent versions.
+	writeOnce       writeOnceMode    // Whether existing objects may be overwritten.
+	cache           *diskcache.Cache // Cache of downloaded data; nil if there is none.
+
+	// ctx is the parent of the contexts of all operations.
+	// It is canceled when the server shuts down.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // New initializes a Storage implementation that stores data to Google Cloud Storage.
@@ -71,42 +124,130 @@ func New(opts *storage.Opts) (storage.Storage, error) {
 	if !ok {
 		return nil, errors.E(op, errors.Invalid, errors.Errorf("%q option is required", defaultACL))
 	}
+	if acl == Uniform || acl == NoACL {
+		// Objects are written without a predefined ACL.
+		acl = ""
+	}
 
-	var client *http.Client
-	if keyData, ok := opts.Opts[privateKeyData]; !ok {
-		// Authentication is provided by the associated service account
-		// when running on Compute Engine.
-		// TODO(adg): remove this once we have deprecated passing
-		// seviceaccount.json around. We should return an error here.
-		var err error
-		client, err = google.DefaultClient(gContext.Background(), scope)
-		if err != nil {
-			return nil, errors.E(op, errors.IO, errors.Errorf("unable to get default client: %s", err))
-		}
-	} else {
-		b, err := base64.StdEncoding.DecodeString(keyData)
-		if err != nil {
-			return nil, errors.E(op, errors.IO, errors.Errorf("unable to decode %s: %s", privateKeyData, err))
-		}
-		cfg, err := google.JWTConfigFromJSON(b, scope)
-		if err != nil {
-			return nil, errors.E(op, errors.Invalid, err)
-		}
-		ctx := gContext.Background()
-		client = oauth2.NewClient(ctx, cfg.TokenSource(ctx))
+	retry, err := newRetryPolicy(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	timeouts, err := newTimeouts(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	linkExpiry, err := newLinkExpiry(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	key, kmsKey, err := newEncryption(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if key != nil && linkExpiry != 0 {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("%s cannot be used with %s", signedURLExpiry, encryptionKey))
+	}
+	if _, hasCache := opts.Opts[cacheDir]; hasCache && key != nil {
+		// The cache would keep the data unencrypted on local disk.
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("%s cannot be used with %s", cacheDir, encryptionKey))
+	}
+	cache, err := newCache(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	keepDeleted, err := newKeepDeleted(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	writeOnce, err := newWriteOnce(opts.Opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	class, hasClass := opts.Opts[storageClass]
+	class = strings.ToUpper(class)
+	if hasClass && !storageClasses[class] {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("unknown %s %q", storageClass, opts.Opts[storageClass]))
 	}
 
-	service, err := gcsBE.New(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	clientOpts := []option.ClientOption{option.WithScopes(scope)}
+	endpoint, hasEndpoint := opts.Opts[gcpEndpoint]
+	if hasEndpoint {
+		clientOpts = append(clientOpts,
+			option.WithEndpoint(strings.TrimSuffix(endpoint, "/")+"/storage/v1/"),
+			// Emulators serve only the JSON API.
+			gcsBE.WithJSONReads())
+	}
+	// Requests to emulators are not authenticated
+	// unless credentials are given.
+	authOpts, signer, err := credentials(ctx, opts.Opts, hasEndpoint)
 	if err != nil {
-		return nil, errors.E(op, errors.IO, errors.Errorf("unable to create storage service: %s", err))
+		cancel()
+		return nil, errors.E(op, err)
 	}
+	clientOpts = append(clientOpts, authOpts...)
 
-	return &gcsImpl{
+	client, err := gcsBE.NewClient(ctx, clientOpts...)
+	if err != nil {
+		cancel()
+		return nil, errors.E(op, errors.IO, errors.Errorf("unable to create storage client: %s", err))
+	}
+
+	gcs := &gcsImpl{
 		client:          client,
-		service:         service,
+		bucket:          client.Bucket(bucket),
 		bucketName:      bucket,
+		prefix:          opts.Opts[objectPrefix],
 		defaultWriteACL: acl,
-	}, nil
+		retry:           retry,
+		timeouts:        timeouts,
+		linkExpiry:      linkExpiry,
+		signer:          signer,
+		encryptionKey:   key,
+		kmsKeyName:      kmsKey,
+		storageClass:    class,
+		keepDeleted:     keepDeleted,
+		writeOnce:       writeOnce,
+		cache:           cache,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+	if err := gcs.checkBucket(); err != nil {
+		cancel()
+		return nil, errors.E(op, err)
+	}
+
+	// Abandon operations in flight when the server shuts down.
+	shutdown.Handle(cancel)
+
+	return gcs, nil
+}
+
+// checkBucket checks that the configuration suits the bucket.
+// Buckets with uniform bucket-level access reject writes that set an ACL,
+// and deleted objects may be restored only from buckets with object
+// versioning. Reading the bucket's metadata requires the storage.buckets.get
+// permission, which service accounts created by older versions of
+// upspin-setupstorage-gcp may lack. If the metadata cannot be read the
+// check is skipped, so the check fails only on a known conflict.
+func (gcs *gcsImpl) checkBucket() error {
+	ctx, cancel := gcs.opContext(gcs.timeouts.list)
+	defer cancel()
+	attrs, err := gcs.bucket.Retryer(gcs.retry.options(ctx)...).Attrs(ctx)
+	if err != nil {
+		log.Info.Printf("cloud/storage/gcs: cannot check configuration of bucket %q: %v", gcs.bucketName, err)
+		return nil
+	}
+	if attrs.UniformBucketLevelAccess.Enabled && gcs.defaultWriteACL != "" {
+		return errors.E(errors.Invalid, errors.Errorf("bucket %q has uniform bucket-level access, so %s must be %q, not %q",
+			gcs.bucketName, defaultACL, Uniform, gcs.defaultWriteACL))
+	}
+	if gcs.keepDeleted && !attrs.VersioningEnabled {
+		return errors.E(errors.Invalid, errors.Errorf("bucket %q does not have object versioning enabled, as %s requires",
+			gcs.bucketName, keepDeletedVersions))
+	}
+	return nil
 }
 
 func init() {
@@ -119,60 +260,314 @@ var _ storage.Storage = (*gcsImpl)(nil)
 // Guarantee we implement the storage.Lister interface.
 var _ storage.Lister = (*gcsImpl)(nil)
 
+// Guarantee we implement the Streamer interface.
+var _ Streamer = (*gcsImpl)(nil)
+
 // LinkBase implements storage.Storage.
+// If the backend signs URLs, there is no base from which every ref may be
+// downloaded and it returns upspin.ErrNotSupported; use RefLink instead.
+// It also returns upspin.ErrNotSupported if objects are encrypted with a
+// customer-supplied key, as they cannot be downloaded without it.
 func (gcs *gcsImpl) LinkBase() (base string, err error) {
-	return "https://storage.googleapis.com/" + gcs.bucketName + "/", nil
+	if gcs.linkExpiry != 0 || gcs.encryptionKey != nil {
+		return "", upspin.ErrNotSupported
+	}
+	return "https://storage.googleapis.com/" + gcs.bucketName + "/" + gcs.prefix, nil
+}
+
+// object returns a handle for the object that stores ref.
+// Operations on the handle are retried according to the retry policy,
+// which starts timing its maximum elapsed time now, and counts retries
+// in the call carried by ctx. They use the customer-supplied encryption
+// key, if any.
+func (gcs *gcsImpl) object(ctx context.Context, ref string) *gcsBE.ObjectHandle {
+	o := gcs.bucket.Object(gcs.prefix + ref).Retryer(gcs.retry.options(ctx)...)
+	if gcs.encryptionKey != nil {
+		o = o.Key(gcs.encryptionKey)
+	}
+	return o
+}
+
+// newWriter returns a writer that stores ref,
+// with the configured ACL, encryption and storage class.
+// If the backend is write-once, the writer fails with
+// a 412 Precondition Failed error if ref exists.
+func (gcs *gcsImpl) newWriter(ctx context.Context, ref string) *gcsBE.Writer {
+	o := gcs.object(ctx, ref)
+	if gcs.writeOnce != writeOnceOff {
+		o = o.If(gcsBE.Conditions{DoesNotExist: true})
+		if c := callFrom(ctx); c != nil {
+			c.existOK = true
+		}
+	}
+	w := o.NewWriter(ctx)
+	w.PredefinedACL = gcs.defaultWriteACL
+	w.KMSKeyName = gcs.kmsKeyName
+	w.StorageClass = gcs.storageClass
+	return w
 }
 
 // Download implements storage.Storage.
-func (gcs *gcsImpl) Download(ref string) ([]byte, error) {
+// If the backend has a cache, data is read from the cache if possible,
+// and otherwise stored in it after it is downloaded.
+func (gcs *gcsImpl) Download(ref string) (_ []byte, err error) {
 	const op errors.Op = "cloud/storage/gcs.Download"
-	resp, err := gcs.service.Objects.Get(gcs.bucketName, ref).Download()
-	if err != nil {
-		if gcsErr, ok := err.(*googleapi.Error); ok && gcsErr.Code == 404 {
-			return nil, errors.E(op, errors.NotExist, err)
+	if gcs.cache != nil {
+		if data, ok := gcs.cache.Get(ref); ok {
+			cacheStats.Add(cacheHits, 1)
+			return data, nil
 		}
-		return nil, errors.E(op, err)
+		cacheStats.Add(cacheMisses, 1)
 	}
-	defer resp.Body.Close()
-	buf, err := ioutil.ReadAll(resp.Body)
+	ctx, cancel := gcs.opContext(gcs.timeouts.download)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endDownload(span, err) }()
+	rc, err := gcs.download(ctx, ref, 0, -1)
 	if err != nil {
-		return nil, errors.E(op, err)
+		return nil, toUpspinError(op, err)
 	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, toUpspinError(op, err)
+	}
+	gcs.cachePut(ref, buf)
 	return buf, nil
 }
 
+// DownloadRange implements Streamer.
+// If the backend has a cache and the data is in it, it is read from the
+// cache. Otherwise the range is downloaded but, being partial, not cached,
+// unless the object is in a cold storage class. Then the whole object is
+// downloaded and cached, so that reading its other ranges later incurs
+// no further retrieval charges.
+func (gcs *gcsImpl) DownloadRange(ref string, offset, length int64) (io.ReadCloser, error) {
+	const op errors.Op = "cloud/storage/gcs.DownloadRange"
+	if offset < 0 {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("negative offset %d", offset))
+	}
+	if length == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	if gcs.cache != nil {
+		if rc, ok, err := gcs.cache.OpenRange(ref, offset, length); ok {
+			cacheStats.Add(cacheHits, 1)
+			if err != nil {
+				return nil, errors.E(op, err)
+			}
+			return rc, nil
+		}
+		cacheStats.Add(cacheMisses, 1)
+		data, ok, err := gcs.downloadCold(ref)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+		if ok {
+			rc, err := readRange(ref, data, offset, length)
+			if err != nil {
+				return nil, errors.E(op, err)
+			}
+			return rc, nil
+		}
+	}
+	// The context must outlive this call, until the caller closes the reader.
+	ctx, cancel := gcs.opContext(gcs.timeouts.download)
+	ctx, span := traceOp(ctx, op)
+	rc, err := gcs.download(ctx, ref, offset, length)
+	if err != nil {
+		cancel()
+		err = toUpspinError(op, err)
+		endDownload(span, err)
+		return nil, err
+	}
+	return cancelOnClose{rc, func() {
+		cancel()
+		endOp(span, nil)
+	}}, nil
+}
+
+// download returns a reader for length bytes of ref starting at offset,
+// or for the rest of the object if length is negative. Reads that fail
+// part way through are resumed by the client library.
+// When the whole object is requested, reading it fails with an errors.IO
+// if the data does not match the checksums stored with it.
+// The call is traced until the reader is closed.
+func (gcs *gcsImpl) download(ctx context.Context, ref string, offset, length int64) (io.ReadCloser, error) {
+	ctx, call := gcs.startCall(ctx, "Get", ref)
+	call.missingOK = true
+	r, err := gcs.object(ctx, ref).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		call.end(err)
+		return nil, err
+	}
+	var rc io.ReadCloser = r
+	if offset == 0 && length < 0 {
+		// The stored checksums cover the whole object.
+		gen := r.Attrs.Generation
+		rc = &verifyingReader{
+			Reader: r,
+			ref:    ref,
+			attrs: func() (*gcsBE.ObjectAttrs, error) {
+				return gcs.object(ctx, ref).Generation(gen).Attrs(ctx)
+			},
+			sums: newChecksums(),
+		}
+	}
+	return &tracedReader{ReadCloser: rc, call: call}, nil
+}
+
 // Put implements storage.Storage.
-func (gcs *gcsImpl) Put(ref string, contents []byte) error {
+// The checksums of the contents are sent with the data,
+// so that Cloud Storage rejects the upload if it is corrupted.
+func (gcs *gcsImpl) Put(ref string, contents []byte) (err error) {
 	const op errors.Op = "cloud/storage/gcs.Put"
-	for tries := 0; ; tries++ {
-		_, err := gcs.service.Objects.Insert(gcs.bucketName, &gcsBE.Object{Name: ref}).
-			Media(bytes.NewReader(contents)).
-			PredefinedAcl(gcs.defaultWriteACL).
-			Do()
-		if err == nil {
-			return nil
+	ctx, cancel := gcs.opContext(gcs.timeouts.put)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+	err = gcs.put(ctx, ref, contents)
+	if gcs.existed(err) {
+		sums := newChecksums()
+		sums.Write(contents)
+		if err := gcs.checkExisting(ctx, ref, sums); err != nil {
+			return errors.E(op, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return toUpspinError(op, err)
+	}
+	return nil
+}
+
+// put uploads contents under ref in a traced call, retrying according
+// to the retry policy.
+func (gcs *gcsImpl) put(ctx context.Context, ref string, contents []byte) (err error) {
+	ctx, call := gcs.startCall(ctx, "Insert", ref)
+	defer func() { call.end(err) }()
+	call.addSize(int64(len(contents)))
+	retry := gcs.retry.shouldRetry(time.Now())
+	backoff := gcs.retry.backoff()
+	for {
+		err = gcs.putOnce(ctx, ref, contents)
+		if err == nil || !retry(err) {
+			return err
+		}
+		call.retried()
+		select {
+		case <-time.After(backoff.Pause()):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// putOnce makes a single attempt to upload contents under ref.
+// The upload is sent from contents in a single request, without
+// the copy that the client library makes to retry a chunk, so
+// put retries it instead.
+func (gcs *gcsImpl) putOnce(ctx context.Context, ref string, contents []byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := gcs.newWriter(ctx, ref)
+	w.CRC32C = crc32.Checksum(contents, crc32cTable)
+	w.SendCRC32C = true
+	sum := md5.Sum(contents)
+	w.MD5 = sum[:]
+	// Stream the contents in a single request rather than copying
+	// them into the writer's buffer.
+	w.ChunkSize = 0
+	if _, err := w.Write(contents); err != nil {
+		// Canceling the context aborts the upload.
+		cancel()
+		return err
+	}
+	return w.Close()
+}
+
+// PutStream implements Streamer.
+// The data is uploaded in chunks of uploadChunkSize bytes, so at most one
+// chunk is held in memory at a time. Each chunk is retried according to
+// the retry policy.
+// As the checksums of the data are not known until it has all been read,
+// they are checked after the upload and a corrupted object is deleted.
+func (gcs *gcsImpl) PutStream(ref string, r io.Reader) (err error) {
+	const op errors.Op = "cloud/storage/gcs.PutStream"
+	ctx, cancel := gcs.opContext(gcs.timeouts.put)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+	sums := newChecksums()
+	attrs, err := gcs.putStream(ctx, ref, io.TeeReader(r, sums))
+	if gcs.existed(err) {
+		if gcs.writeOnce == writeOnceVerify {
+			// Checksum the data that was not sent.
+			if _, err := io.Copy(sums, r); err != nil {
+				return errors.E(op, errors.IO, err)
+			}
 		}
-		if !strings.Contains(err.Error(), "503") {
+		if err := gcs.checkExisting(ctx, ref, sums); err != nil {
 			return errors.E(op, err)
 		}
-		if tries > 4 {
-			return errors.E(op, errors.Transient, err)
+		return nil
+	}
+	if err != nil {
+		// Canceling the context aborts the upload.
+		cancel()
+		return toUpspinError(op, err)
+	}
+	if err := sums.verify(ref, encodeCRC32C(attrs.CRC32C), encodeMD5(attrs.MD5)); err != nil {
+		// Don't leave corrupted data behind.
+		ctx, call := gcs.startCall(ctx, "Delete", ref)
+		delErr := gcs.object(ctx, ref).Delete(ctx)
+		call.end(delErr)
+		if delErr != nil {
+			log.Error.Printf("cloud/storage/gcs: deleting corrupted %q: %v", ref, delErr)
 		}
-		log.Info.Printf("cloud/storage/gcs: WARNING: retrying Insert(%s): %s", ref, err)
-		time.Sleep(time.Duration(100*(tries+1)) * time.Millisecond)
+		return errors.E(op, err)
 	}
+	return nil
+}
+
+// putStream uploads the data read from r under ref in a traced call,
+// and returns the attributes of the new object.
+func (gcs *gcsImpl) putStream(ctx context.Context, ref string, r io.Reader) (_ *gcsBE.ObjectAttrs, err error) {
+	ctx, call := gcs.startCall(ctx, "Insert", ref)
+	defer func() { call.end(err) }()
+	w := gcs.newWriter(ctx, ref)
+	w.ChunkSize = uploadChunkSize
+	n, err := io.Copy(w, r)
+	call.addSize(n)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
 }
 
+// uploadChunkSize is the size of the chunks in which PutStream uploads data.
+const uploadChunkSize = 1 << 20
+
 // Delete implements storage.Storage.
-func (gcs *gcsImpl) Delete(ref string) error {
+// In a bucket with object versioning, the object is kept as a noncurrent
+// version that Restore may make live again.
+func (gcs *gcsImpl) Delete(ref string) (err error) {
 	const op errors.Op = "cloud/storage/gcs.Delete"
-	err := gcs.service.Objects.Delete(gcs.bucketName, ref).Do()
+	ctx, cancel := gcs.opContext(gcs.timeouts.delete)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+	if gcs.cache != nil {
+		gcs.cache.Delete(ref)
+	}
+	ctx, call := gcs.startCall(ctx, "Delete", ref)
+	err = gcs.object(ctx, ref).Delete(ctx)
+	call.end(err)
 	if err != nil {
-		if gcsErr, ok := err.(*googleapi.Error); ok && gcsErr.Code == 404 {
-			return errors.E(op, errors.NotExist, err)
-		}
-		return errors.E(op, err)
+		return toUpspinError(op, err)
 	}
 	return nil
 }
@@ -180,73 +575,54 @@ func (gcs *gcsImpl) Delete(ref string) error {
 // maxResults specifies the number of references to return from each call to
 // List. The Cloud Storage API limits this to 1000. It is a variable here so
 // that it may be overridden in tests.
-var maxResults int64 = 1000
+var maxResults = 1000
 
 // List implements storage.Lister.
 func (gcs *gcsImpl) List(token string) (refs []upspin.ListRefsItem, nextToken string, err error) {
-	call := gcs.service.Objects.List(gcs.bucketName).
-		MaxResults(maxResults).
-		Fields("items(name,size),nextPageToken")
-	if token != "" {
-		call = call.PageToken(token)
-	}
-	objs, err := call.Do()
+	const op errors.Op = "cloud/storage/gcs.List"
+	ctx, cancel := gcs.opContext(gcs.timeouts.list)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+	objs, nextToken, err := gcs.listPage(ctx, gcsBE.Query{}, maxResults, token, "Name", "Size")
 	if err != nil {
-		return nil, "", err
+		return nil, "", toUpspinError(op, err)
 	}
-	for _, obj := range objs.Items {
+	for _, obj := range objs {
 		refs = append(refs, upspin.ListRefsItem{
 			Ref:  upspin.Reference(obj.Name),
-			Size: int64(obj.Size),
+			Size: obj.Size,
 		})
 	}
-	return refs, objs.NextPageToken, nil
+	return refs, nextToken, nil
 }
 
-// emptyBucket completely removes all files in a bucket permanently.
-// If verbose is true, every attempt to delete a file is logged to the standard logger.
-// This is an expensive operation. It is also dangerous, so use with care.
-// Use for testing only.
-func (gcs *gcsImpl) emptyBucket(verbose bool) error {
-	const maxParallelDeletes = 10
-	pageToken := ""
-	var firstErr error
-	recordErr := func(err error) bool {
-		if err == nil {
-			return false
-		}
-		if firstErr == nil {
-			firstErr = err
-		}
-		return true
+// listPage returns a page of at most n objects stored by the backend that
+// match the query, starting at the given page token, and the token for the
+// next page. The query's Prefix, StartOffset and EndOffset are relative to
+// the object prefix, which is removed from the names of the objects, leaving
+// the refs. Only the named attributes of each object are populated.
+// The call is traced, with the number of objects listed as its size.
+func (gcs *gcsImpl) listPage(ctx context.Context, q gcsBE.Query, n int, token string, attrs ...string) (objs []*gcsBE.ObjectAttrs, nextToken string, err error) {
+	ctx, call := gcs.startCall(ctx, "List", "")
+	defer func() {
+		call.addSize(int64(len(objs)))
+		call.end(err)
+	}()
+	q.Prefix = gcs.prefix + q.Prefix
+	if q.StartOffset != "" {
+		q.StartOffset = gcs.prefix + q.StartOffset
 	}
-	for {
-		objs, err := gcs.service.Objects.List(gcs.bucketName).
-			MaxResults(maxParallelDeletes).
-			Fields("items(name),nextPageToken").
-			PageToken(pageToken).
-			Do()
-		if recordErr(err) {
-			log.Error.Printf("emptyBucket: List(%q): %v", gcs.bucketName, err)
-			break
-		}
-		if verbose {
-			log.Printf("Deleting %d items from bucket %s", len(objs.Items), gcs.bucketName)
-		}
-		for _, o := range objs.Items {
-			if verbose {
-				log.Printf("Deleting: %q", o.Name)
-			}
-			err = gcs.Delete(o.Name)
-			if recordErr(err) {
-				log.Error.Printf("emptyBucket: Delete(%q): %v", o.Name, err)
-				continue
-			}
-		}
-		if objs.NextPageToken == "" {
-			break
-		}
-		pageToken = objs.NextPageToken
+	if q.EndOffset != "" {
+		q.EndOffset = gcs.prefix + q.EndOffset
+	}
+	if err := q.SetAttrSelection(attrs); err != nil {
+		return nil, "", err
+	}
+	it := gcs.bucket.Retryer(gcs.retry.options(ctx)...).Objects(ctx, &q)
+	nextToken, err = iterator.NewPager(it, n, token).NextPage(&objs)
+	for _, o := range objs {
+		o.Name = strings.TrimPrefix(o.Name, gcs.prefix)
 	}
-	return firstErr
+	return objs, nextToken, err
 }
@@ -5,14 +5,33 @@
 package gcs
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"gcp.upspin.io/cloud/spanerr"
+	"gcp.upspin.io/cloud/storage/gcs/gcstest"
+
 	"upspin.io/cloud/storage"
+	"upspin.io/errors"
 	"upspin.io/log"
+	"upspin.io/metric"
 	"upspin.io/upspin"
 )
 
@@ -26,6 +45,10 @@ var (
 
 	testBucket = flag.String("test_bucket", defaultTestBucketName, "bucket name to use for testing")
 	useGcloud  = flag.Bool("use_gcloud", false, "enable to run google cloud tests; requires gcloud auth login")
+
+	// fake is a fake GCS server. Tests that control the server's behavior
+	// use it through dialFake; the others use it unless -use_gcloud is set.
+	fake *gcstest.Server
 )
 
 // This is more of a regression test as it uses the running cloud
@@ -69,13 +92,48 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestStream(t *testing.T) {
+	const ref = "test-stream"
+	err := PutStream(client, ref, strings.NewReader(testDataStr))
+	if err != nil {
+		t.Fatalf("Can't PutStream: %v", err)
+	}
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, testDataStr},
+		{0, 4, testDataStr[:4]},
+		{5, -1, testDataStr[5:]},
+		{5, 2, testDataStr[5:7]},
+		{0, 0, ""},
+	} {
+		rc, err := DownloadRange(client, ref, tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("DownloadRange(%d, %d): %v", tc.offset, tc.length, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("DownloadRange(%d, %d): reading: %v", tc.offset, tc.length, err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("DownloadRange(%d, %d) = %q, want %q", tc.offset, tc.length, b, tc.want)
+		}
+	}
+	_, err = DownloadRange(client, "does-not-exist", 0, -1)
+	if !errors.Is(errors.NotExist, err) {
+		t.Errorf("DownloadRange of missing ref: got error %v, want NotExist", err)
+	}
+}
+
 func TestList(t *testing.T) {
 	ls, ok := client.(storage.Lister)
 	if !ok {
 		t.Fatal("impl does not provide List method")
 	}
 
-	if err := client.(*gcsImpl).emptyBucket(false); err != nil {
+	if err := drain(client); err != nil {
 		t.Fatal(err)
 	}
 
@@ -131,24 +189,1216 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListObjects(t *testing.T) {
+	ol, ok := client.(ObjectLister)
+	if !ok {
+		t.Fatal("impl does not provide ListObjects method")
+	}
+	if err := drain(client); err != nil {
+		t.Fatal(err)
+	}
+
+	oldMaxResults := maxResults
+	defer func() { maxResults = oldMaxResults }()
+	maxResults = 3
+
+	// Refs are mostly hex, but the ranges must cover any ref.
+	want := make(map[upspin.Reference]bool)
+	for i := 0; i < 40; i++ {
+		want[upspin.Reference(fmt.Sprintf("%02x%d", i*37%256, i))] = true
+	}
+	want["-other"] = true
+	want["zzz"] = true
+	for ref := range want {
+		if err := client.Put(string(ref), testData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sums := newChecksums()
+	sums.Write(testData)
+
+	list := func(opts ListOptions, stopAfter int) (seen map[upspin.Reference]bool, token string, err error) {
+		seen = make(map[upspin.Reference]bool)
+		errStop := errors.Str("stop")
+		calls := 0
+		err = ol.ListObjects(opts, func(objs []ObjectInfo, tok string) error {
+			for _, o := range objs {
+				if seen[o.Ref] {
+					t.Errorf("saw duplicate ref %q", o.Ref)
+				}
+				seen[o.Ref] = true
+				if o.Size != int64(len(testData)) || o.Generation == 0 || o.Created.IsZero() ||
+					o.StorageClass == "" || o.CRC32C != sums.CRC32C() || o.MD5 != sums.MD5() {
+					t.Errorf("bad info for %q: %+v", o.Ref, o)
+				}
+			}
+			token = tok
+			calls++
+			if calls == stopAfter {
+				return errStop
+			}
+			return nil
+		})
+		if err == errStop {
+			err = nil
+		}
+		return seen, token, err
+	}
+
+	for _, n := range []int{0, 1, 3, 16, 100} {
+		seen, _, err := list(ListOptions{Parallelism: n}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != len(want) {
+			t.Errorf("parallelism %d: listed %d refs, want %d", n, len(seen), len(want))
+		}
+		for ref := range want {
+			if !seen[ref] {
+				t.Errorf("parallelism %d: %q not listed", n, ref)
+			}
+		}
+	}
+
+	seen, _, err := list(ListOptions{Prefix: "2", Parallelism: 4}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref := range want {
+		if seen[ref] != strings.HasPrefix(string(ref), "2") {
+			t.Errorf("prefix 2: listed %q is %v", ref, seen[ref])
+		}
+	}
+
+	// Stop part way through and resume from the last token.
+	first, token, err := list(ListOptions{Parallelism: 4}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) == 0 || len(first) == len(want) {
+		t.Fatalf("listed %d refs before stopping", len(first))
+	}
+	rest, _, err := list(ListOptions{Token: token}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref := range want {
+		if first[ref] == rest[ref] {
+			t.Errorf("%q listed before stopping: %v, after resuming: %v", ref, first[ref], rest[ref])
+		}
+	}
+
+	if err := ol.ListObjects(ListOptions{Token: "bogus"}, nil); !errors.Is(errors.Invalid, err) {
+		t.Errorf("ListObjects with bad token: got error %v, want Invalid", err)
+	}
+}
+
+func TestPutRetry(t *testing.T) {
+	c := dialFake(t)
+	const ref = "test-retry"
+
+	// A few 503s are retried.
+	fake.Fail(http.StatusServiceUnavailable, 3)
+	if err := c.Put(ref, testData); err != nil {
+		t.Fatalf("Put with transient failures: %v", err)
+	}
+	if got, ok := fake.Contents(*testBucket, ref); !ok || string(got) != testDataStr {
+		t.Errorf("after Put, bucket holds %q, %t; want %q", got, ok, testDataStr)
+	}
+
+	// Persistent 503s eventually surface as a Transient error.
+	fake.Fail(http.StatusServiceUnavailable, 100)
+	defer fake.Fail(0, 0)
+	err := c.Put(ref, testData)
+	if !errors.Is(errors.Transient, err) {
+		t.Errorf("Put with persistent failures: got error %v, want Transient", err)
+	}
+}
+
+func TestRetryAllOperations(t *testing.T) {
+	c := dialFake(t)
+	const ref = "test-retry-all"
+	if err := c.Put(ref, testData); err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Fail(0, 0)
+	for _, code := range []int{
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	} {
+		fake.Fail(code, 2)
+		if _, err := c.Download(ref); err != nil {
+			t.Errorf("Download after two %d errors: %v", code, err)
+		}
+		fake.Fail(code, 2)
+		if _, _, err := c.(storage.Lister).List(""); err != nil {
+			t.Errorf("List after two %d errors: %v", code, err)
+		}
+		fake.Fail(code, 2)
+		rc, err := DownloadRange(c, ref, 1, 2)
+		if err != nil {
+			t.Errorf("DownloadRange after two %d errors: %v", code, err)
+		} else {
+			rc.Close()
+		}
+	}
+	fake.Fail(http.StatusServiceUnavailable, 2)
+	if err := c.Delete(ref); err != nil {
+		t.Errorf("Delete after two 503 errors: %v", err)
+	}
+
+	// Errors that are not transient are not retried.
+	fake.Fail(http.StatusForbidden, 1)
+	before := fake.Requests()
+	_, err := c.Download(ref)
+	if err == nil || errors.Is(errors.Transient, err) {
+		t.Errorf("Download after 403 error: got error %v, want non-transient error", err)
+	}
+	if got := fake.Requests() - before; got != 1 {
+		t.Errorf("Download after 403 error made %d requests, want 1", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c := dialFake(t, "downloadTimeout", "50ms")
+	const ref = "test-timeout"
+	if err := c.Put(ref, testData); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetLatency(time.Second)
+	defer fake.SetLatency(0)
+
+	start := time.Now()
+	_, err := c.Download(ref)
+	if err == nil {
+		t.Fatal("Download succeeded, want timeout")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Download took %v, want it abandoned after about 50ms", d)
+	}
+}
+
+func TestShutdownCancels(t *testing.T) {
+	c := dialFake(t)
+	fake.SetLatency(time.Second)
+	defer fake.SetLatency(0)
+
+	errc := make(chan error)
+	go func() {
+		errc <- c.Put("test-shutdown", testData)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	c.(*gcsImpl).cancel()
+	if err := <-errc; err == nil {
+		t.Fatal("Put succeeded, want it canceled")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Put returned %v after cancelation, want promptly", d)
+	}
+}
+
+func TestObjectPrefix(t *testing.T) {
+	a := dialFake(t, "gcpObjectPrefix", "a/")
+	b := dialFake(t, "gcpObjectPrefix", "b/")
+	const ref = "test-prefix"
+	if err := a.Put(ref, []byte("in a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ref, []byte("in b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ref+"-2", testData); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := fake.Contents(*testBucket, "a/"+ref); !ok || string(got) != "in a" {
+		t.Errorf("object a/%s holds %q, %t; want %q", ref, got, ok, "in a")
+	}
+	if got, err := b.Download(ref); err != nil || string(got) != "in b" {
+		t.Errorf("Download from b = %q, %v; want %q", got, err, "in b")
+	}
+
+	refs, _, err := a.(storage.Lister).List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Ref != ref {
+		t.Errorf("List of a = %v, want just %q", refs, ref)
+	}
+
+	base, err := b.LinkBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/" + *testBucket + "/b/"; !strings.HasSuffix(base, want) {
+		t.Errorf("LinkBase = %q, want suffix %q", base, want)
+	}
+
+	if err := drain(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Download(ref); err != nil {
+		t.Errorf("Drain of b removed a's data: %v", err)
+	}
+	if err := a.Delete(ref); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniformAccess(t *testing.T) {
+	const bucket = "test-uniform"
+	fake.SetUniformAccess(bucket, true)
+
+	_, err := storage.Dial("GCS", fakeOpts("gcpBucketName", bucket, "defaultACL", PublicRead)...)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("Dial with defaultACL=%s: got error %v, want Invalid", PublicRead, err)
+	}
+
+	// If the bucket's configuration cannot be read, it is not checked.
+	for _, acl := range []string{Private, Uniform} {
+		fake.Fail(http.StatusForbidden, 1)
+		_, err = storage.Dial("GCS", fakeOpts("gcpBucketName", bucket, "defaultACL", acl)...)
+		fake.Fail(0, 0)
+		if err != nil {
+			t.Errorf("Dial with defaultACL=%s for unreadable bucket: %v", acl, err)
+		}
+	}
+
+	for _, acl := range []string{Uniform, NoACL} {
+		c := dialFake(t, "gcpBucketName", bucket, "defaultACL", acl)
+		if err := c.Put("test-uniform", testData); err != nil {
+			t.Errorf("Put with defaultACL=%s: %v", acl, err)
+		}
+		if err := PutStream(c, "test-uniform", strings.NewReader(testDataStr)); err != nil {
+			t.Errorf("PutStream with defaultACL=%s: %v", acl, err)
+		}
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	email, keyJSON := serviceAccountKey(t)
+	keyData := base64.StdEncoding.EncodeToString(keyJSON)
+
+	for _, expiry := range []string{"0s", "-1h", "8d", "169h", "soon"} {
+		_, err := storage.Dial("GCS", fakeOpts("defaultACL", Private, "signedURLExpiry", expiry)...)
+		if !errors.Is(errors.Invalid, err) {
+			t.Errorf("Dial with signedURLExpiry=%s: got error %v, want Invalid", expiry, err)
+		}
+	}
+
+	c := dialFake(t, "defaultACL", Private, "privateKeyData", keyData, "signedURLExpiry", "1h", "gcpObjectPrefix", "signed/")
+	if _, err := c.LinkBase(); err != upspin.ErrNotSupported {
+		t.Errorf("LinkBase: got error %v, want %v", err, upspin.ErrNotSupported)
+	}
+	before := time.Now()
+	link, expires, err := RefLink(c, "ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Before(before.Add(time.Hour)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("link expires at %v, want an hour from %v", expires, before)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/" + *testBucket + "/signed/ref"; u.Path != want {
+		t.Errorf("link path is %q, want %q", u.Path, want)
+	}
+	q := u.Query()
+	if got, want := q.Get("X-Goog-Algorithm"), "GOOG4-RSA-SHA256"; got != want {
+		t.Errorf("link has X-Goog-Algorithm=%q, want %q", got, want)
+	}
+	if got := q.Get("X-Goog-Credential"); !strings.HasPrefix(got, email+"/") {
+		t.Errorf("link has X-Goog-Credential=%q, want it signed by %s", got, email)
+	}
+	if q.Get("X-Goog-Signature") == "" {
+		t.Error("link is not signed")
+	}
+
+	// Without signing, links are formed from the LinkBase.
+	base, err := client.LinkBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, expires, err = RefLink(client, "ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != base+"ref" || !expires.IsZero() {
+		t.Errorf("RefLink = %q, %v; want %q, zero time", link, expires, base+"ref")
+	}
+}
+
+// serviceAccountKey returns the email address and JSON key of a made-up
+// service account whose tokens are granted by the fake server.
+func serviceAccountKey(t *testing.T) (email string, keyJSON []byte) {
+	email = "upspin-test@example.iam.gserviceaccount.com"
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err = json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": email,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    fake.TokenURL(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return email, keyJSON
+}
+
+func TestCredentials(t *testing.T) {
+	dir := t.TempDir()
+	_, keyJSON := serviceAccountKey(t)
+	keyFile := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(keyFile, keyJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("subject-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	externalJSON, err := json.Marshal(map[string]interface{}{
+		"type":               "external_account",
+		"audience":           "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          fake.TokenURL(),
+		"credential_source":  map[string]string{"file": tokenFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData := base64.StdEncoding.EncodeToString(keyJSON)
+	externalData := base64.StdEncoding.EncodeToString(externalJSON)
+
+	for _, kv := range [][]string{
+		{"gcpCredentialsFile", keyFile},
+		{"externalAccountData", externalData},
+	} {
+		c := dialFake(t, kv...)
+		if err := c.Put("test-credentials", testData); err != nil {
+			t.Errorf("Put with %s: %v", kv[0], err)
+			continue
+		}
+		if err := c.Delete("test-credentials"); err != nil {
+			t.Errorf("Delete with %s: %v", kv[0], err)
+		}
+	}
+
+	for _, test := range []struct {
+		kv   []string
+		kind errors.Kind
+	}{
+		{[]string{"privateKeyData", keyData, "gcpCredentialsFile", keyFile}, errors.Invalid},
+		{[]string{"gcpCredentialsFile", filepath.Join(dir, "missing.json")}, errors.IO},
+		{[]string{"externalAccountData", keyData}, errors.Invalid},
+		{[]string{"externalAccountData", "not base64"}, errors.IO},
+		{[]string{"impersonateDelegates", "a@example.com"}, errors.Invalid},
+		{[]string{"impersonateServiceAccount", ""}, errors.Invalid},
+	} {
+		if _, err := storage.Dial("GCS", fakeOpts(test.kv...)...); !errors.Is(test.kind, err) {
+			t.Errorf("Dial with %q: got error %v, want %v", test.kv, err, test.kind)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	newKey := func() string {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(key)
+	}
+	key := newKey()
+	const kmsKey = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+	for _, kv := range [][]string{
+		{"encryptionKey", key, "kmsKeyName", kmsKey},
+		{"encryptionKey", "not base64"},
+		{"encryptionKey", base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"encryptionKey", key, "signedURLExpiry", "1h"},
+		{"kmsKeyName", ""},
+	} {
+		if _, err := storage.Dial("GCS", fakeOpts(kv...)...); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Dial with %q: got error %v, want Invalid", kv, err)
+		}
+	}
+
+	// Objects encrypted with a customer-supplied key can be read only with that key.
+	plain := dialFake(t)
+	c := dialFake(t, "encryptionKey", key)
+	if _, err := c.LinkBase(); err != upspin.ErrNotSupported {
+		t.Errorf("LinkBase: got error %v, want %v", err, upspin.ErrNotSupported)
+	}
+	if err := c.Put("test-csek", testData); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutStream(c, "test-csek-stream", strings.NewReader(testDataStr)); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"test-csek", "test-csek-stream"} {
+		data, err := c.Download(ref)
+		if err != nil {
+			t.Fatalf("Download(%q): %v", ref, err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Errorf("Download(%q) = %q, want %q", ref, data, testData)
+		}
+		rc, err := DownloadRange(c, ref, 1, 3)
+		if err != nil {
+			t.Fatalf("DownloadRange(%q): %v", ref, err)
+		}
+		data, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testData[1:4]; !bytes.Equal(data, want) {
+			t.Errorf("DownloadRange(%q) = %q, want %q", ref, data, want)
+		}
+		if _, err := plain.Download(ref); err == nil {
+			t.Errorf("Download(%q) without the key succeeded", ref)
+		}
+		if _, err := dialFake(t, "encryptionKey", newKey()).Download(ref); err == nil {
+			t.Errorf("Download(%q) with the wrong key succeeded", ref)
+		}
+	}
+
+	// Objects encrypted with a Cloud KMS key are written with the key name
+	// and read as usual.
+	c = dialFake(t, "kmsKeyName", kmsKey)
+	if err := c.Put("test-cmek", testData); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutStream(c, "test-cmek-stream", strings.NewReader(testDataStr)); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"test-cmek", "test-cmek-stream"} {
+		if got := fake.KMSKeyName(*testBucket, ref); got != kmsKey {
+			t.Errorf("%q is encrypted with %q, want %q", ref, got, kmsKey)
+		}
+		data, err := plain.Download(ref)
+		if err != nil {
+			t.Fatalf("Download(%q): %v", ref, err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Errorf("Download(%q) = %q, want %q", ref, data, testData)
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	_, err := storage.Dial("GCS", fakeOpts("storageClass", "tepid")...)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("Dial with unknown storage class: got error %v, want Invalid", err)
+	}
+
+	c := dialFake(t, "storageClass", "coldline")
+	if err := c.Put("test-cold", testData); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutStream(c, "test-cold-stream", strings.NewReader(testDataStr)); err != nil {
+		t.Fatal(err)
+	}
+	classes := make(map[upspin.Reference]string)
+	err = c.(ObjectLister).ListObjects(ListOptions{Prefix: "test-"}, func(objs []ObjectInfo, _ string) error {
+		for _, o := range objs {
+			classes[o.Ref] = o.StorageClass
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []upspin.Reference{"test-cold", "test-cold-stream"} {
+		if got, want := classes[ref], "COLDLINE"; got != want {
+			t.Errorf("%q has storage class %q, want %q", ref, got, want)
+		}
+		data, err := c.Download(string(ref))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Errorf("Download(%q) = %q, want %q", ref, data, testData)
+		}
+	}
+
+	// Reading a range of a cold object caches the whole object,
+	// so that its retrieval is charged once.
+	cached := dialFake(t, "cacheDir", t.TempDir())
+	for i := 0; i < 2; i++ {
+		n := fake.Requests()
+		rc, err := DownloadRange(cached, "test-cold", int64(i), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testData[i : i+2]; !bytes.Equal(data, want) {
+			t.Errorf("DownloadRange = %q, want %q", data, want)
+		}
+		if cached := fake.Requests() == n; cached != (i > 0) {
+			t.Errorf("DownloadRange %d served from cache: %v", i, cached)
+		}
+	}
+	// Ranges of other objects are not cached.
+	if err := cached.Put("test-warm", testData); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		n := fake.Requests()
+		rc, err := DownloadRange(cached, "test-warm", 0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		if fake.Requests() == n {
+			t.Errorf("DownloadRange %d of a STANDARD object served from cache", i)
+		}
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	bucket := *testBucket + "-versioned"
+	_, err := storage.Dial("GCS", fakeOpts("gcpBucketName", bucket, "keepDeletedVersions", "true")...)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("Dial with keepDeletedVersions for unversioned bucket: got error %v, want Invalid", err)
+	}
+	fake.SetVersioning(bucket, true)
+	c := dialFake(t, "gcpBucketName", bucket, "keepDeletedVersions", "true", "storageClass", "nearline")
+	r := c.(Restorer)
+
+	const ref = "test-versioned"
+	if err := r.Restore(ref); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Restore of missing ref: got error %v, want NotExist", err)
+	}
+	if err := c.Put(ref, testData); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Restore(ref); !errors.Is(errors.Exist, err) {
+		t.Errorf("Restore of live ref: got error %v, want Exist", err)
+	}
+	if err := c.Delete(ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Download(ref); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("Download after Delete: got error %v, want NotExist", err)
+	}
+
+	versions, next, err := r.ListNoncurrent("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "" || len(versions) != 1 {
+		t.Fatalf("ListNoncurrent = %v, %q; want one version", versions, next)
+	}
+	if v := versions[0]; v.Ref != ref || v.Size != int64(len(testData)) || v.Deleted.IsZero() {
+		t.Errorf("ListNoncurrent returned %+v", v)
+	}
+
+	if err := r.Restore(ref); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Download(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, testData) {
+		t.Errorf("Download after Restore = %q, want %q", got, testData)
+	}
+	info := make(map[upspin.Reference]ObjectInfo)
+	err = c.(ObjectLister).ListObjects(ListOptions{}, func(objs []ObjectInfo, _ string) error {
+		for _, o := range objs {
+			info[o.Ref] = o
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info[ref].StorageClass, "NEARLINE"; got != want {
+		t.Errorf("restored object has storage class %q, want %q", got, want)
+	}
+	if versions[0].Generation == info[ref].Generation {
+		t.Errorf("restored object has the generation of the noncurrent version")
+	}
+
+	// Drain deletes noncurrent versions too.
+	if err := c.Put("test-versioned-2", testData); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("test-versioned-2"); err != nil {
+		t.Fatal(err)
+	}
+	var last DrainProgress
+	err = c.(Drainer).Drain(DrainOptions{Confirm: bucket, Progress: func(p DrainProgress) { last = p }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (DrainProgress{Listed: 3, Deleted: 3}); last != want {
+		t.Errorf("final progress = %+v, want %+v", last, want)
+	}
+	if versions, _, err := r.ListNoncurrent(""); err != nil || len(versions) != 0 {
+		t.Errorf("after Drain, ListNoncurrent = %v, %v; want no versions", versions, err)
+	}
+	if objs := fake.Objects(bucket); len(objs) != 0 {
+		t.Errorf("after Drain, bucket holds %v", objs)
+	}
+}
+
+func TestCache(t *testing.T) {
+	_, err := storage.Dial("GCS", fakeOpts("cacheDir", t.TempDir(), "cacheSize", "lots")...)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("Dial with bad cache size: got error %v, want Invalid", err)
+	}
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	_, err = storage.Dial("GCS", fakeOpts("cacheDir", t.TempDir(), "encryptionKey", key)...)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("Dial with cache and encryption key: got error %v, want Invalid", err)
+	}
+
+	c := dialFake(t, "cacheDir", t.TempDir(), "cacheSize", "1000")
+	const ref = "test-cached"
+	if err := c.Put(ref, testData); err != nil {
+		t.Fatal(err)
+	}
+	count := func(name string) int64 {
+		v, _ := cacheStats.Get(name).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	hits, misses := count(cacheHits), count(cacheMisses)
+
+	// The first Download misses the cache; the rest are served from it.
+	for i := 0; i < 3; i++ {
+		n := fake.Requests()
+		data, err := c.Download(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Errorf("Download = %q, want %q", data, testData)
+		}
+		if cached := fake.Requests() == n; cached != (i > 0) {
+			t.Errorf("Download %d served from cache: %v", i, cached)
+		}
+	}
+	n := fake.Requests()
+	rc, err := DownloadRange(c, ref, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testData[2:6]; !bytes.Equal(data, want) {
+		t.Errorf("DownloadRange = %q, want %q", data, want)
+	}
+	if fake.Requests() != n {
+		t.Error("DownloadRange not served from cache")
+	}
+	if got, want := count(cacheHits)-hits, int64(3); got != want {
+		t.Errorf("counted %d hits, want %d", got, want)
+	}
+	if got, want := count(cacheMisses)-misses, int64(1); got != want {
+		t.Errorf("counted %d misses, want %d", got, want)
+	}
+
+	// Ranges beyond the end are invalid, as they are when not cached.
+	if _, err := DownloadRange(c, ref, int64(len(testData))+1, 1); !errors.Is(errors.Invalid, err) {
+		t.Errorf("DownloadRange beyond the end: got error %v, want Invalid", err)
+	}
+
+	// Deleted data is removed from the cache.
+	if err := c.Delete(ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Download(ref); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Download after Delete: got error %v, want NotExist", err)
+	}
+}
+
+func TestReplicated(t *testing.T) {
+	dial := func(primary string, keyValues ...string) *replicated {
+		kv := append([]string{"gcpBucketName", primary, "retryMaxElapsed", "10ms"}, keyValues...)
+		c, err := storage.Dial("GCSReplicated", fakeOpts(kv...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*replicated)
+	}
+	has := func(bucket, ref string) bool {
+		data, ok := fake.Contents(bucket, ref)
+		return ok && bytes.Equal(data, testData)
+	}
+	count := func(name string) int64 {
+		v, _ := replicationStats.Get(name).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+
+	for _, kv := range [][]string{
+		{},
+		{"gcpReplicaBuckets", "r", "replicationMode", "async"},
+		{"gcpReplicaBuckets", "r", "replicationMode", "eventual"},
+		{"gcpReplicaBuckets", "r", "replicationRetryInterval", "often"},
+	} {
+		kv = append([]string{"gcpBucketName", "p"}, kv...)
+		if _, err := storage.Dial("GCSReplicated", fakeOpts(kv...)...); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Dial with %q: got error %v, want Invalid", kv, err)
+		}
+	}
+
+	// In sync mode, every bucket is written.
+	r := dial("sync-p", "gcpReplicaBuckets", "sync-r1; sync-r2")
+	if err := r.Put("ref", testData); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"sync-p", "sync-r1", "sync-r2"} {
+		if !has(b, "ref") {
+			t.Errorf("bucket %q lacks ref after sync Put", b)
+		}
+	}
+
+	// Reads fall back to the replicas, counting the divergence.
+	if err := r.replicas[0].Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	missing, fallbacks := count(replMissing), count(replFallbacks)
+	data, err := r.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Errorf("Download = %q, want %q", data, testData)
+	}
+	if count(replMissing) != missing+1 || count(replFallbacks) != fallbacks+1 {
+		t.Errorf("Download did not count the missing ref and fallback")
+	}
+
+	// Unhealthy buckets are tried last.
+	r.replicas[1].record(errors.E(errors.Transient, "down"))
+	if r.replicas[1].healthy() {
+		t.Error("bucket healthy after failure")
+	}
+	n := fake.Requests()
+	if _, err := r.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	// The data is checked against the checksums stored with it.
+	if got := fake.Requests() - n; got != 3 {
+		t.Errorf("Download made %d requests, want 3 (primary, then healthy replica and its checksums)", got)
+	}
+
+	if err := r.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"sync-p", "sync-r1", "sync-r2"} {
+		if has(b, "ref") {
+			t.Errorf("bucket %q has ref after Delete", b)
+		}
+	}
+	if _, err := r.Download("ref"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Download after Delete: got error %v, want NotExist", err)
+	}
+
+	// In sync mode with a queue, failed writes to replicas are queued.
+	r = dial("queue-p", "gcpReplicaBuckets", "queue-r", "replicationQueueDir", t.TempDir(), "replicationRetryInterval", "1h")
+	fake.SetUniformAccess("queue-r", true) // Writes with an ACL now fail.
+	if err := r.Put("ref", testData); err != nil {
+		t.Fatal(err)
+	}
+	if !has("queue-p", "ref") || has("queue-r", "ref") {
+		t.Fatal("Put did not write only to the primary")
+	}
+	r.flushQueue()
+	if has("queue-r", "ref") {
+		t.Fatal("queued write succeeded while replica failing")
+	}
+	fake.SetUniformAccess("queue-r", false)
+	r.flushQueue()
+	if !has("queue-r", "ref") {
+		t.Error("queued write not applied")
+	}
+
+	// Without a queue, failed writes to replicas fail the Put.
+	r = dial("noqueue-p", "gcpReplicaBuckets", "noqueue-r")
+	fake.SetUniformAccess("noqueue-r", true)
+	defer fake.SetUniformAccess("noqueue-r", false)
+	if err := r.Put("ref", testData); err == nil {
+		t.Error("Put succeeded despite failing replica")
+	}
+
+	// In async mode, the replicas are written from the queue.
+	dir := t.TempDir()
+	r = dial("async-p", "gcpReplicaBuckets", "async-r", "replicationMode", "async", "replicationQueueDir", dir, "replicationRetryInterval", "1h")
+	r.queueMu.Lock() // Hold off the queue processor.
+	if err := r.Put("ref", testData); err != nil {
+		t.Fatal(err)
+	}
+	if !has("async-p", "ref") || has("async-r", "ref") {
+		t.Fatal("async Put did not write only to the primary")
+	}
+	r.queueMu.Unlock()
+	// A new backend using the same queue applies the queued write.
+	r = dial("async-p", "gcpReplicaBuckets", "async-r", "replicationMode", "async", "replicationQueueDir", dir, "replicationRetryInterval", "1h")
+	r.flushQueue()
+	if !has("async-r", "ref") {
+		t.Error("queued async write not applied")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d entries left in queue", len(files))
+	}
+}
+
+// dialFake returns a new GCS client that talks to the fake server,
+// configured with the given key-value pairs in addition to the defaults.
+func dialFake(t *testing.T, keyValues ...string) storage.Storage {
+	c, err := storage.Dial("GCS", fakeOpts(keyValues...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// fakeOpts returns the options for dialing the fake server: the defaults
+// followed by the given key-value pairs, which override them.
+func fakeOpts(keyValues ...string) []storage.DialOpts {
+	opts := []storage.DialOpts{
+		storage.WithKeyValue("gcpBucketName", *testBucket),
+		storage.WithKeyValue("defaultACL", PublicRead),
+		storage.WithKeyValue("gcpEndpoint", fake.URL),
+		// Retry quickly so that tests of persistent failures are fast.
+		storage.WithKeyValue("retryInitialBackoff", "1ms"),
+		storage.WithKeyValue("retryMaxBackoff", "10ms"),
+		storage.WithKeyValue("retryMaxElapsed", "200ms"),
+	}
+	for i := 0; i < len(keyValues); i += 2 {
+		opts = append(opts, storage.WithKeyValue(keyValues[i], keyValues[i+1]))
+	}
+	return opts
+}
+
+func TestChecksums(t *testing.T) {
+	c := dialFake(t)
+	const ref = "test-checksums"
+
+	// Corruption on upload is rejected by the server for Put,
+	// and detected by the client for PutStream.
+	fake.CorruptUploads(true)
+	err := c.Put(ref, testData)
+	if err == nil {
+		t.Error("Put of corrupted data succeeded")
+	}
+	err = PutStream(c, ref, strings.NewReader(testDataStr))
+	if !errors.Is(errors.IO, err) {
+		t.Errorf("PutStream of corrupted data: got error %v, want IO", err)
+	}
+	if _, ok := fake.Contents(*testBucket, ref); ok {
+		t.Error("corrupted data left in bucket after PutStream")
+	}
+	fake.CorruptUploads(false)
+
+	// Corruption at rest is detected on download.
+	if err := c.Put(ref, testData); err != nil {
+		t.Fatal(err)
+	}
+	fake.Corrupt(*testBucket, ref)
+	_, err = c.Download(ref)
+	if !errors.Is(errors.IO, err) {
+		t.Errorf("Download of corrupted data: got error %v, want IO", err)
+	}
+	rc, err := DownloadRange(c, ref, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if !errors.Is(errors.IO, err) {
+		t.Errorf("reading corrupted data from DownloadRange: got error %v, want IO", err)
+	}
+
+	// It is detected even if the data is served without its checksums.
+	fake.OmitHashes(true)
+	defer fake.OmitHashes(false)
+	_, err = c.Download(ref)
+	if !errors.Is(errors.IO, err) {
+		t.Errorf("Download of corrupted data without checksums: got error %v, want IO", err)
+	}
+}
+
+func TestPutStreamChunked(t *testing.T) {
+	c := dialFake(t)
+	const ref = "test-stream-chunked"
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*uploadChunkSize+100)/16)
+	before := fake.Requests()
+	if err := PutStream(c, ref, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// One request to start the upload and one per chunk.
+	if got, want := fake.Requests()-before, 4; got != want {
+		t.Errorf("PutStream made %d requests, want %d", got, want)
+	}
+	got, err := c.Download(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Download returned %d bytes, want the %d that were streamed", len(got), len(data))
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	_, err := storage.Dial("GCS", fakeOpts("writeOnce", "always")...)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("Dial with bad writeOnce: got error %v, want Invalid", err)
+	}
+
+	const ref = "test-write-once"
+	other := []byte("something else entirely")
+	once := dialFake(t, "writeOnce", "true")
+	if err := once.Put(ref, testData); err != nil {
+		t.Fatal(err)
+	}
+	// Without verification, a different write succeeds
+	// but leaves the object untouched.
+	if err := once.Put(ref, other); err != nil {
+		t.Errorf("Put of existing ref: %v", err)
+	}
+	if err := PutStream(once, ref, bytes.NewReader(other)); err != nil {
+		t.Errorf("PutStream of existing ref: %v", err)
+	}
+	if got, _ := fake.Contents(*testBucket, ref); !bytes.Equal(got, testData) {
+		t.Errorf("existing ref was overwritten with %q", got)
+	}
+
+	verify := dialFake(t, "writeOnce", "verify")
+	if err := verify.Put(ref, testData); err != nil {
+		t.Errorf("Put of identical data: %v", err)
+	}
+	if err := PutStream(verify, ref, strings.NewReader(testDataStr)); err != nil {
+		t.Errorf("PutStream of identical data: %v", err)
+	}
+	if err := verify.Put(ref, other); !errors.Is(errors.Exist, err) {
+		t.Errorf("Put of different data: got error %v, want Exist", err)
+	}
+	if err := PutStream(verify, ref, bytes.NewReader(other)); !errors.Is(errors.Exist, err) {
+		t.Errorf("PutStream of different data: got error %v, want Exist", err)
+	}
+	if got, _ := fake.Contents(*testBucket, ref); !bytes.Equal(got, testData) {
+		t.Errorf("existing ref was overwritten with %q", got)
+	}
+
+	// A new ref is written as usual.
+	if err := verify.Delete(ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutStream(verify, ref, bytes.NewReader(other)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fake.Contents(*testBucket, ref); !bytes.Equal(got, other) {
+		t.Errorf("got %q, want %q", got, other)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	if err := drain(client); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if err := client.Put(fmt.Sprintf("test-drain-%d", i), testData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := client.(Drainer)
+	err := d.Drain(DrainOptions{Confirm: "not-" + *testBucket})
+	if !errors.Is(errors.Invalid, err) {
+		t.Fatalf("Drain with wrong confirmation: got error %v, want Invalid", err)
+	}
+	refs, _, err := client.(storage.Lister).List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 25 {
+		t.Fatalf("after unconfirmed Drain, bucket holds %d refs, want 25", len(refs))
+	}
+
+	// Rates too high for the limiter are no limit.
+	for _, qps := range []float64{1000, 1e9, 1e12, math.Inf(1)} {
+		for i := 0; i < 25; i++ {
+			if err := client.Put(fmt.Sprintf("test-drain-%d", i), testData); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var last DrainProgress
+		err = d.Drain(DrainOptions{
+			Confirm:     *testBucket,
+			Concurrency: 4,
+			QPS:         qps,
+			Progress:    func(p DrainProgress) { last = p },
+		})
+		if err != nil {
+			t.Fatalf("Drain with QPS %g: %v", qps, err)
+		}
+		if want := (DrainProgress{Listed: 25, Deleted: 25}); last != want {
+			t.Errorf("with QPS %g, final progress = %+v, want %+v", qps, last, want)
+		}
+		refs, _, err = client.(storage.Lister).List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != 0 {
+			t.Errorf("after Drain with QPS %g, bucket holds %d refs, want 0", qps, len(refs))
+		}
+	}
+}
+
+func TestDrainRetries(t *testing.T) {
+	c := dialFake(t)
+	defer func(d time.Duration) { drainRetryDelay = d }(drainRetryDelay)
+	drainRetryDelay = time.Millisecond
+
+	if err := drain(c); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := c.Put(fmt.Sprintf("test-drain-%d", i), testData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The failures are not retried by the client, so the first list
+	// and the first deletes fail and must be retried by Drain.
+	fake.Fail(http.StatusForbidden, 3)
+	defer fake.Fail(0, 0)
+	var last DrainProgress
+	err := c.(Drainer).Drain(DrainOptions{
+		Confirm:     *testBucket,
+		Concurrency: 1,
+		Progress:    func(p DrainProgress) { last = p },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (DrainProgress{Listed: 5, Deleted: 5}); last != want {
+		t.Errorf("final progress = %+v, want %+v", last, want)
+	}
+	if objs := fake.Objects(*testBucket); len(objs) != 0 {
+		t.Errorf("after Drain, bucket holds %v", objs)
+	}
+
+	// Persistent failures are reported.
+	if err := c.Put("test-drain-0", testData); err != nil {
+		t.Fatal(err)
+	}
+	fake.Fail(http.StatusForbidden, 1000)
+	err = c.(Drainer).Drain(DrainOptions{Confirm: *testBucket, Retries: 1})
+	if err == nil {
+		t.Error("Drain with persistent failures succeeded")
+	}
+}
+
+// drain drains the bucket of the storage backend s.
+func drain(s storage.Storage) error {
+	return s.(Drainer).Drain(DrainOptions{Confirm: *testBucket})
+}
+
+func TestTrace(t *testing.T) {
+	c := dialFake(t)
+	var metrics []*metric.Metric
+	defer func(f func(*metric.Metric)) { onTrace = f }(onTrace)
+	onTrace = func(m *metric.Metric) { metrics = append(metrics, m) }
+
+	// The first attempt fails and is retried.
+	fake.Fail(http.StatusServiceUnavailable, 1)
+	if err := c.Put("test-trace", testData); err != nil {
+		t.Fatal(err)
+	}
+	// A missing object is the answer to a download, not a failure of it.
+	if _, err := c.Download("test-trace-missing"); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("Download of missing ref: got error %v, want NotExist", err)
+	}
+	fake.Fail(http.StatusForbidden, 1)
+	if err := c.Put("test-trace-denied", testData); err == nil {
+		t.Fatal("Put succeeded despite a failure")
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("recorded %d metrics, want 3", len(metrics))
+	}
+	for i, want := range []struct {
+		root, call metric.SpanName
+		annotation string
+		failed     bool
+	}{
+		{"cloud/storage/gcs.Put", "cloud/storage/gcs.Insert",
+			fmt.Sprintf("bucket=%s ref=test-trace size=%d retries=1 status=200", *testBucket, len(testData)), false},
+		{"cloud/storage/gcs.Download", "cloud/storage/gcs.Get",
+			fmt.Sprintf("bucket=%s ref=test-trace-missing size=0 retries=0 status=404", *testBucket), false},
+		{"cloud/storage/gcs.Put", "cloud/storage/gcs.Insert",
+			fmt.Sprintf("bucket=%s ref=test-trace-denied size=%d retries=0 status=403 error", *testBucket, len(testData)), true},
+	} {
+		spans := metrics[i].Spans()
+		if len(spans) != 2 {
+			t.Errorf("metric %d has %d spans, want 2", i, len(spans))
+			continue
+		}
+		root, call := spans[0], spans[1]
+		if root.Name != want.root || call.Name != want.call || call.ParentSpan != root {
+			t.Errorf("metric %d has spans %q and %q (child: %t), want %q with child %q",
+				i, root.Name, call.Name, call.ParentSpan == root, want.root, want.call)
+		}
+		if call.Kind != metric.Client {
+			t.Errorf("span %q has kind %v, want %v", call.Name, call.Kind, metric.Client)
+		}
+		if call.Annotation != want.annotation {
+			t.Errorf("span %q annotated %q, want %q", call.Name, call.Annotation, want.annotation)
+		}
+		if spanerr.Is(root.Annotation) != want.failed {
+			t.Errorf("metric %d: span %q annotated %q, want failed %t", i, root.Name, root.Annotation, want.failed)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
-	if !*useGcloud {
+
+	fake = gcstest.NewServer()
+	opts := fakeOpts()
+	if *useGcloud {
+		opts = []storage.DialOpts{
+			storage.WithKeyValue("gcpBucketName", *testBucket),
+			storage.WithKeyValue("defaultACL", PublicRead),
+		}
+	} else {
 		log.Printf(`
 
-cloud/storage/gcs: skipping test as it requires GCS access. To enable this test,
-ensure you are authenticated to a GCP project that has editor permissions to a
-GCS bucket named by flag -test_bucket and then set this test's flag -use_gcloud.
+cloud/storage/gcs: running tests against a fake GCS server. To run them against
+Google Cloud Storage, ensure you are authenticated to a GCP project that has
+editor permissions to a GCS bucket named by flag -test_bucket and then set this
+test's flag -use_gcloud. Tests that control the server's behavior always use
+the fake.
 
 `)
-		os.Exit(0)
 	}
 
 	// Create client that writes to test bucket.
 	var err error
-	client, err = storage.Dial("GCS",
-		storage.WithKeyValue("gcpBucketName", *testBucket),
-		storage.WithKeyValue("defaultACL", PublicRead))
+	client, err = storage.Dial("GCS", opts...)
 	if err != nil {
 		log.Fatalf("cloud/storage/gcs: couldn't set up client: %v", err)
 	}
@@ -156,10 +1406,16 @@ GCS bucket named by flag -test_bucket and then set this test's flag -use_gcloud.
 	code := m.Run()
 
 	// Clean up.
-	const verbose = true
-	if err := client.(*gcsImpl).emptyBucket(verbose); err != nil {
-		log.Printf("cloud/storage/gcs: emptyBucket failed: %v", err)
+	err = client.(Drainer).Drain(DrainOptions{
+		Confirm: *testBucket,
+		Progress: func(p DrainProgress) {
+			log.Printf("Deleted %d of %d items from bucket %s", p.Deleted, p.Listed, *testBucket)
+		},
+	})
+	if err != nil {
+		log.Printf("cloud/storage/gcs: Drain failed: %v", err)
 	}
+	fake.Close()
 
 	os.Exit(code)
 }
@@ -0,0 +1,872 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gcstest provides an in-process stand-in for Google Cloud Storage
+// for use in tests. It implements the subset of the storage/v1 JSON API that
+// is used by the gcs storage backend: inserting (simple, multipart and
+// resumable uploads), fetching, deleting, listing and copying objects,
+// including objects encrypted with customer-supplied or Cloud KMS keys and
+// noncurrent versions of objects in buckets with object versioning.
+// It also serves an OAuth 2.0 token endpoint that grants every request,
+// so that clients using service account keys or external account
+// configurations may talk to it.
+package gcstest // import "gcp.upspin.io/cloud/storage/gcs/gcstest"
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Google Cloud Storage server.
+// Buckets spring into existence when they are first written to.
+type Server struct {
+	// URL is the base URL of the server, suitable for use as the
+	// gcpEndpoint option of the gcs storage backend.
+	URL string
+
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	buckets    map[string]map[string]*object
+	noncurrent map[string][]*object // Noncurrent versions of objects, by bucket.
+	uniform    map[string]bool      // Buckets with uniform bucket-level access.
+	versioned  map[string]bool      // Buckets with object versioning.
+	uploads    map[string]*upload
+	nextUpload int
+	generation int64
+	failures   []int // Status codes with which to fail the next requests.
+	requests   int
+	latency    time.Duration
+	corrupt    bool // Whether to corrupt uploaded data.
+	omitHashes bool // Whether to serve data without its checksums.
+}
+
+// object is a stored object.
+type object struct {
+	name        string
+	data        []byte
+	generation  int64
+	created     time.Time
+	crc32c, md5 string    // Checksums of the data as it was uploaded.
+	class       string    // Storage class.
+	kmsKeyName  string    // Cloud KMS key that encrypted the object, if any.
+	keySHA256   string    // Hash of the customer-supplied key that encrypted the object, if any.
+	deleted     time.Time // When the object became noncurrent; zero if it is live.
+}
+
+// upload is an in-progress resumable upload.
+type upload struct {
+	bucket    string
+	meta      objectResource
+	keySHA256 string
+	data      []byte
+}
+
+// NewServer starts and returns a new Server.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		buckets:    make(map[string]map[string]*object),
+		noncurrent: make(map[string][]*object),
+		uniform:    make(map[string]bool),
+		versioned:  make(map[string]bool),
+		uploads:    make(map[string]*upload),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Fail arranges for the next n requests to fail with the given HTTP status
+// code, replacing any failures arranged earlier. Fail(0, 0) cancels pending
+// failures.
+func (s *Server) Fail(code, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = s.failures[:0]
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, code)
+	}
+}
+
+// SetLatency arranges for the server to wait for d before
+// handling each subsequent request.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// CorruptUploads sets whether the server damages the data it receives before
+// storing it, as if it had been corrupted in transit. Uploads that carry
+// checksums of their data are then rejected.
+func (s *Server) CorruptUploads(corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.corrupt = corrupt
+}
+
+// Corrupt damages the data stored in the named object,
+// without changing its recorded checksums.
+func (s *Server) Corrupt(bucket, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.buckets[bucket][name]; ok && len(o.data) > 0 {
+		o.data[0] ^= 0xff
+	}
+}
+
+// OmitHashes sets whether the server omits the checksums of the data it
+// serves from its responses, so that the data cannot be checked against
+// them without fetching the object's metadata.
+func (s *Server) OmitHashes(omit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.omitHashes = omit
+}
+
+// SetUniformAccess sets whether the bucket has uniform bucket-level access
+// enabled. When it does, uploads that specify a predefined ACL are rejected.
+func (s *Server) SetUniformAccess(bucket string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uniform[bucket] = enabled
+}
+
+// SetVersioning sets whether the bucket has object versioning enabled.
+// When it does, objects that are deleted or overwritten become noncurrent
+// versions, which are listed when versions are requested and may be
+// fetched, copied and deleted by generation.
+func (s *Server) SetVersioning(bucket string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versioned[bucket] = enabled
+}
+
+// Requests reports the number of requests served so far,
+// including those that failed.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Objects returns the sorted names of the objects stored in the bucket.
+func (s *Server) Objects(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.buckets[bucket] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Contents returns the data stored in the named object,
+// and whether the object exists.
+func (s *Server) Contents(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+const (
+	apiPrefix    = "/storage/v1/b/"
+	uploadPrefix = "/upload/storage/v1/b/"
+	tokenPath    = "/token"
+
+	// keySHA256Header carries the hash of a customer-supplied encryption key.
+	keySHA256Header = "X-Goog-Encryption-Key-Sha256"
+)
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	if latency > 0 {
+		// Read the request first, so that the server notices if the
+		// client abandons it while it waits, and does not then store
+		// an upload that the client has given up on.
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if len(s.failures) > 0 {
+		code := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, code, "injected failure")
+		return
+	}
+
+	path := r.URL.EscapedPath()
+	switch {
+	case path == tokenPath && r.Method == "POST":
+		writeJSON(w, map[string]interface{}{
+			"access_token": "fake-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		return
+	case strings.HasPrefix(path, uploadPrefix):
+		bucket, rest := splitPath(strings.TrimPrefix(path, uploadPrefix))
+		if rest != "o" || r.Method != "POST" {
+			break
+		}
+		s.serveUpload(w, r, bucket)
+		return
+	case strings.HasPrefix(path, apiPrefix):
+		bucket, rest := splitPath(strings.TrimPrefix(path, apiPrefix))
+		switch {
+		case rest == "" && r.Method == "GET":
+			s.serveBucket(w, bucket)
+			return
+		case rest == "o" && r.Method == "GET":
+			s.serveList(w, r, bucket)
+			return
+		case strings.HasPrefix(rest, "o/"):
+			rest, dst := rest, ""
+			if i := strings.Index(rest, "/rewriteTo/b/"); i >= 0 {
+				rest, dst = rest[:i], rest[i+len("/rewriteTo/b/"):]
+			}
+			name, err := url.PathUnescape(strings.TrimPrefix(rest, "o/"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if dst != "" && r.Method == "POST" {
+				s.serveRewrite(w, r, bucket, name, dst)
+				return
+			}
+			s.serveObject(w, r, bucket, name)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown request "+r.Method+" "+path)
+}
+
+// KMSKeyName returns the name of the Cloud KMS key that encrypted the
+// named object, or the empty string if there is no such object or it was
+// not encrypted with a Cloud KMS key.
+func (s *Server) KMSKeyName(bucket, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		return ""
+	}
+	return o.kmsKeyName
+}
+
+// TokenURL returns the URL of the server's OAuth 2.0 token endpoint,
+// for use as the token_uri of a service account key.
+func (s *Server) TokenURL() string {
+	return s.URL + tokenPath
+}
+
+// splitPath splits "bucket/rest" into its two components.
+func splitPath(p string) (bucket, rest string) {
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return p, ""
+	}
+	return p[:i], p[i+1:]
+}
+
+// lookup returns the named object, or the version of it with the
+// generation in the request's generation parameter, if present.
+func (s *Server) lookup(r *http.Request, bucket, name string) (*object, bool) {
+	o, ok := s.buckets[bucket][name]
+	gen := r.URL.Query().Get("generation")
+	if gen == "" {
+		return o, ok
+	}
+	if ok && strconv.FormatInt(o.generation, 10) == gen {
+		return o, true
+	}
+	for _, o := range s.noncurrent[bucket] {
+		if o.name == name && strconv.FormatInt(o.generation, 10) == gen {
+			return o, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	o, ok := s.lookup(r, bucket, name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("alt") != "media" {
+			writeJSON(w, o.resource(bucket))
+			return
+		}
+		if key := r.Header.Get(keySHA256Header); key != o.keySHA256 {
+			if key == "" {
+				writeError(w, http.StatusBadRequest, "The target object is encrypted by a customer-supplied encryption key.")
+			} else {
+				writeError(w, http.StatusForbidden, "The provided encryption key is incorrect.")
+			}
+			return
+		}
+		data := o.data
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+		if !s.omitHashes {
+			w.Header().Set("X-Goog-Hash", "crc32c="+o.crc32c+",md5="+o.md5)
+		}
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseRange(rng, int64(len(data)))
+			if !ok {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "invalid range "+rng)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+			data = data[start:end]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		w.Write(data)
+	case "DELETE":
+		s.remove(bucket, o, r.URL.Query().Get("generation") != "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, r.Method)
+	}
+}
+
+// remove removes the object from the bucket. A live object in a bucket with
+// versioning becomes noncurrent, unless permanent is set.
+func (s *Server) remove(bucket string, o *object, permanent bool) {
+	if !o.deleted.IsZero() {
+		versions := s.noncurrent[bucket]
+		for i, v := range versions {
+			if v == o {
+				s.noncurrent[bucket] = append(versions[:i:i], versions[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	delete(s.buckets[bucket], o.name)
+	if s.versioned[bucket] && !permanent {
+		o.deleted = time.Now()
+		s.noncurrent[bucket] = append(s.noncurrent[bucket], o)
+	}
+}
+
+// parseRange parses an HTTP Range header of the form "bytes=start-[end]"
+// for an object of the given size, and returns the half-open interval it
+// selects.
+func parseRange(rng string, size int64) (start, end int64, ok bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	i := strings.Index(spec, "-")
+	if spec == rng || i < 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(spec[:i], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if spec[i+1:] != "" {
+		last, err := strconv.ParseInt(spec[i+1:], 10, 64)
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < end {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
+
+func (s *Server) serveList(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix, start, end := q.Get("prefix"), q.Get("startOffset"), q.Get("endOffset")
+	objs := make(map[string]*object)
+	add := func(o *object) {
+		if !strings.HasPrefix(o.name, prefix) || o.name < start || end != "" && o.name >= end {
+			return
+		}
+		objs[o.key()] = o
+	}
+	for _, o := range s.buckets[bucket] {
+		add(o)
+	}
+	if q.Get("versions") == "true" {
+		for _, o := range s.noncurrent[bucket] {
+			add(o)
+		}
+	}
+	var keys []string
+	for k := range objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if tok := q.Get("pageToken"); tok != "" {
+		i := sort.SearchStrings(keys, tok)
+		keys = keys[i:]
+	}
+	next := ""
+	if max, err := strconv.Atoi(q.Get("maxResults")); err == nil && max > 0 && len(keys) > max {
+		next = keys[max]
+		keys = keys[:max]
+	}
+
+	var items []*objectResource
+	for _, k := range keys {
+		items = append(items, objs[k].resource(bucket))
+	}
+	writeJSON(w, &struct {
+		Kind          string            `json:"kind"`
+		Items         []*objectResource `json:"items,omitempty"`
+		NextPageToken string            `json:"nextPageToken,omitempty"`
+	}{"storage#objects", items, next})
+}
+
+// serveBucket replies with the metadata of the bucket.
+func (s *Server) serveBucket(w http.ResponseWriter, bucket string) {
+	type enabled struct {
+		Enabled bool `json:"enabled"`
+	}
+	type iamConfiguration struct {
+		UniformBucketLevelAccess enabled `json:"uniformBucketLevelAccess"`
+	}
+	writeJSON(w, &struct {
+		Kind             string           `json:"kind"`
+		Name             string           `json:"name"`
+		IamConfiguration iamConfiguration `json:"iamConfiguration"`
+		Versioning       enabled          `json:"versioning"`
+	}{
+		Kind:             "storage#bucket",
+		Name:             bucket,
+		IamConfiguration: iamConfiguration{enabled{s.uniform[bucket]}},
+		Versioning:       enabled{s.versioned[bucket]},
+	})
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	if s.uniform[bucket] && q.Get("predefinedAcl") != "" {
+		writeError(w, http.StatusBadRequest, "Cannot insert legacy ACL for an object when uniform bucket-level access is enabled.")
+		return
+	}
+	switch q.Get("uploadType") {
+	case "media":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !s.checkDoesNotExist(w, r, bucket, q.Get("name")) {
+			return
+		}
+		s.finishUpload(w, bucket, &objectResource{Name: q.Get("name"), KmsKeyName: q.Get("kmsKeyName")}, r.Header.Get(keySHA256Header), data)
+	case "multipart":
+		var meta objectResource
+		data, err := readMultipart(r, &meta)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if meta.Name == "" {
+			meta.Name = q.Get("name")
+		}
+		if meta.KmsKeyName == "" {
+			meta.KmsKeyName = q.Get("kmsKeyName")
+		}
+		if !s.checkDoesNotExist(w, r, bucket, meta.Name) {
+			return
+		}
+		s.finishUpload(w, bucket, &meta, r.Header.Get(keySHA256Header), data)
+	case "resumable":
+		if id := q.Get("upload_id"); id != "" {
+			s.serveChunk(w, r, id)
+			return
+		}
+		var meta objectResource
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if meta.Name == "" {
+			meta.Name = q.Get("name")
+		}
+		if meta.KmsKeyName == "" {
+			meta.KmsKeyName = q.Get("kmsKeyName")
+		}
+		if !s.checkDoesNotExist(w, r, bucket, meta.Name) {
+			return
+		}
+		s.nextUpload++
+		id := strconv.Itoa(s.nextUpload)
+		s.uploads[id] = &upload{bucket: bucket, meta: meta, keySHA256: r.Header.Get(keySHA256Header)}
+		loc := *r.URL
+		q.Set("upload_id", id)
+		loc.RawQuery = q.Encode()
+		w.Header().Set("Location", s.URL+loc.RequestURI())
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported uploadType "+q.Get("uploadType"))
+	}
+}
+
+// checkDoesNotExist checks the request's ifGenerationMatch=0 precondition,
+// if present, that the named object does not exist, replying with an error
+// if it fails. A resumable upload is checked only when it starts, which
+// suffices for the tests.
+func (s *Server) checkDoesNotExist(w http.ResponseWriter, r *http.Request, bucket, name string) bool {
+	if r.URL.Query().Get("ifGenerationMatch") != "0" {
+		return true
+	}
+	if _, ok := s.buckets[bucket][name]; ok {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return false
+	}
+	return true
+}
+
+// serveChunk accepts one chunk of a resumable upload.
+func (s *Server) serveChunk(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such upload "+id)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Content-Range is "bytes first-last/total", "bytes first-last/*",
+	// or "bytes */total".
+	cr := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	i := strings.LastIndex(cr, "/")
+	if i < 0 {
+		writeError(w, http.StatusBadRequest, "bad Content-Range "+cr)
+		return
+	}
+	if first := strings.SplitN(cr[:i], "-", 2)[0]; first != "*" {
+		off, err := strconv.Atoi(first)
+		if err != nil || off > len(u.data) {
+			writeError(w, http.StatusBadRequest, "bad Content-Range "+cr)
+			return
+		}
+		// A retried chunk overwrites what was sent before.
+		u.data = append(u.data[:off], data...)
+	}
+	if cr[i+1:] == "*" {
+		// Not the final chunk; signal "resume incomplete".
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		if len(u.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.data)-1))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	delete(s.uploads, id)
+	s.finishUpload(w, u.bucket, &u.meta, u.keySHA256, u.data)
+}
+
+// finishUpload stores a completed upload and replies with its metadata.
+// If the upload's metadata includes checksums, they must match the data.
+// The keySHA256 argument is the hash of the customer-supplied encryption
+// key sent with the upload, if any.
+func (s *Server) finishUpload(w http.ResponseWriter, bucket string, meta *objectResource, keySHA256 string, data []byte) {
+	name := meta.Name
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "object name required")
+		return
+	}
+	data = append([]byte(nil), data...)
+	if s.corrupt && len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	crc, sum := crc32cString(data), md5String(data)
+	if meta.Crc32c != "" && meta.Crc32c != crc {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Provided CRC32C %q doesn't match calculated CRC32C %q.", meta.Crc32c, crc))
+		return
+	}
+	if meta.Md5Hash != "" && meta.Md5Hash != sum {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Provided MD5 hash %q doesn't match calculated MD5 hash %q.", meta.Md5Hash, sum))
+		return
+	}
+	o := &object{
+		name:       name,
+		data:       data,
+		crc32c:     crc,
+		md5:        sum,
+		class:      meta.StorageClass,
+		kmsKeyName: meta.KmsKeyName,
+		keySHA256:  keySHA256,
+	}
+	s.store(bucket, o)
+	writeJSON(w, o.resource(bucket))
+}
+
+// store makes the object the live version of its name in the bucket,
+// assigning it a generation and creation time.
+func (s *Server) store(bucket string, o *object) {
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = make(map[string]*object)
+		s.buckets[bucket] = b
+	}
+	if old, ok := b[o.name]; ok {
+		s.remove(bucket, old, false)
+	}
+	if o.class == "" {
+		o.class = "STANDARD"
+	}
+	s.generation++
+	o.generation = s.generation
+	o.created = time.Now()
+	b[o.name] = o
+}
+
+// serveRewrite copies an object, or a version of it, to dst, which is of the
+// form "bucket/o/name". The copy is made in a single call. The destination
+// takes the storage class and encryption given in the request.
+func (s *Server) serveRewrite(w http.ResponseWriter, r *http.Request, bucket, name, dst string) {
+	q := r.URL.Query()
+	srcGen := q.Get("sourceGeneration")
+	var src *object
+	if o, ok := s.buckets[bucket][name]; ok && (srcGen == "" || strconv.FormatInt(o.generation, 10) == srcGen) {
+		src = o
+	} else if srcGen != "" {
+		for _, o := range s.noncurrent[bucket] {
+			if o.name == name && strconv.FormatInt(o.generation, 10) == srcGen {
+				src = o
+			}
+		}
+	}
+	if src == nil {
+		writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+		return
+	}
+	if key := r.Header.Get("X-Goog-Copy-Source-Encryption-Key-Sha256"); key != src.keySHA256 {
+		writeError(w, http.StatusBadRequest, "The source object's customer-supplied encryption key is missing or incorrect.")
+		return
+	}
+	dstBucket, rest := splitPath(dst)
+	dstName, err := url.PathUnescape(strings.TrimPrefix(rest, "o/"))
+	if err != nil || !strings.HasPrefix(rest, "o/") {
+		writeError(w, http.StatusBadRequest, "bad rewrite destination "+dst)
+		return
+	}
+	if s.uniform[dstBucket] && q.Get("destinationPredefinedAcl") != "" {
+		writeError(w, http.StatusBadRequest, "Cannot insert legacy ACL for an object when uniform bucket-level access is enabled.")
+		return
+	}
+	if q.Get("ifGenerationMatch") == "0" {
+		if _, ok := s.buckets[dstBucket][dstName]; ok {
+			writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+	}
+	var meta objectResource
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	o := &object{
+		name:       dstName,
+		data:       src.data,
+		crc32c:     src.crc32c,
+		md5:        src.md5,
+		class:      meta.StorageClass,
+		kmsKeyName: q.Get("destinationKmsKeyName"),
+		keySHA256:  r.Header.Get(keySHA256Header),
+	}
+	s.store(dstBucket, o)
+	size := strconv.Itoa(len(o.data))
+	writeJSON(w, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"totalBytesRewritten": size,
+		"objectSize":          size,
+		"done":                true,
+		"resource":            o.resource(dstBucket),
+	})
+}
+
+// readMultipart reads a multipart/related upload body, decoding the JSON
+// metadata in the first part into meta and returning the media in the second.
+func readMultipart(r *http.Request, meta *objectResource) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	p, err := mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(p).Decode(meta); err != nil {
+		return nil, err
+	}
+	p, err = mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(p)
+}
+
+// objectResource is the JSON representation of an object.
+type objectResource struct {
+	Kind         string `json:"kind,omitempty"`
+	Name         string `json:"name"`
+	Bucket       string `json:"bucket,omitempty"`
+	Size         string `json:"size,omitempty"`
+	Generation   string `json:"generation,omitempty"`
+	TimeCreated  string `json:"timeCreated,omitempty"`
+	Updated      string `json:"updated,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Md5Hash      string `json:"md5Hash,omitempty"`
+	Crc32c       string `json:"crc32c,omitempty"`
+	KmsKeyName   string `json:"kmsKeyName,omitempty"`
+	TimeDeleted  string `json:"timeDeleted,omitempty"`
+
+	CustomerEncryption *customerEncryption `json:"customerEncryption,omitempty"`
+}
+
+// customerEncryption describes the customer-supplied key
+// that encrypted an object.
+type customerEncryption struct {
+	EncryptionAlgorithm string `json:"encryptionAlgorithm"`
+	KeySha256           string `json:"keySha256"`
+}
+
+// key returns a string that orders versions of objects by name,
+// then by generation.
+func (o *object) key() string {
+	return fmt.Sprintf("%s\x00%020d", o.name, o.generation)
+}
+
+func (o *object) resource(bucket string) *objectResource {
+	created := o.created.UTC().Format(time.RFC3339Nano)
+	var enc *customerEncryption
+	if o.keySHA256 != "" {
+		enc = &customerEncryption{EncryptionAlgorithm: "AES256", KeySha256: o.keySHA256}
+	}
+	deleted := ""
+	if !o.deleted.IsZero() {
+		deleted = o.deleted.UTC().Format(time.RFC3339Nano)
+	}
+	return &objectResource{
+		Kind:         "storage#object",
+		Name:         o.name,
+		Bucket:       bucket,
+		Size:         strconv.Itoa(len(o.data)),
+		Generation:   strconv.FormatInt(o.generation, 10),
+		TimeCreated:  created,
+		Updated:      created,
+		StorageClass: o.class,
+		Md5Hash:      o.md5,
+		Crc32c:       o.crc32c,
+		KmsKeyName:   o.kmsKeyName,
+		TimeDeleted:  deleted,
+
+		CustomerEncryption: enc,
+	}
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32cString returns the base64-encoded big-endian CRC32C checksum of b,
+// as reported by Cloud Storage.
+func crc32cString(b []byte) string {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b, crc32cTable))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// md5String returns the base64-encoded MD5 hash of b.
+func md5String(b []byte) string {
+	sum := md5.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(buf.Bytes())
+}
+
+// writeError writes an error reply in the format used by Google APIs.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	reason := "backendError"
+	switch code {
+	case http.StatusNotFound:
+		reason = "notFound"
+	case http.StatusBadRequest:
+		reason = "invalid"
+	case http.StatusTooManyRequests:
+		reason = "rateLimitExceeded"
+	}
+	type errorItem struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	var body struct {
+		Error struct {
+			Code    int         `json:"code"`
+			Message string      `json:"message"`
+			Errors  []errorItem `json:"errors"`
+		} `json:"error"`
+	}
+	body.Error.Code = code
+	body.Error.Message = msg
+	body.Error.Errors = []errorItem{{reason, msg}}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&body)
+}
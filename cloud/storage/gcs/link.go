@@ -0,0 +1,99 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// signedURLExpiry, if set, is the lifetime of the signed URLs through which
+// refs may be downloaded directly from the bucket, in the format accepted by
+// time.ParseDuration. It allows direct downloads from private buckets.
+// When it is set LinkBase reports that it is not supported, as there is no
+// single public URL for the bucket, and links are made by RefLink instead.
+//
+// URLs are signed with the service account key in privateKeyData or
+// credentialsFile if one is set. Otherwise they are signed by the IAM
+// signBlob API on behalf of the impersonated service account, or else the
+// service account the server runs as, which must have the Service Account
+// Token Creator role on itself.
+const signedURLExpiry = "signedURLExpiry"
+
+// maxSignedURLExpiry is the longest lifetime Cloud Storage permits
+// for a V4 signed URL.
+const maxSignedURLExpiry = 7 * 24 * time.Hour
+
+// RefLinker is implemented by storage backends that can provide a link
+// through which a single ref may be downloaded directly, such as a signed
+// URL for an object in a private bucket. A storeserver may hand such links
+// to clients in place of one formed from the LinkBase.
+type RefLinker interface {
+	// RefLink returns a URL from which the data stored under ref may be
+	// downloaded and the time at which the URL stops working.
+	// A zero time means the URL does not expire.
+	RefLink(ref string) (url string, expires time.Time, err error)
+}
+
+// Guarantee we implement the RefLinker interface.
+var _ RefLinker = (*gcsImpl)(nil)
+
+// RefLink returns a URL from which the data stored under ref in s may be
+// downloaded, using s's RefLink method if s implements RefLinker and
+// otherwise appending ref to s's LinkBase.
+func RefLink(s storage.Storage, ref string) (url string, expires time.Time, err error) {
+	if l, ok := s.(RefLinker); ok {
+		return l.RefLink(ref)
+	}
+	base, err := s.LinkBase()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return base + ref, time.Time{}, nil
+}
+
+// newLinkExpiry returns the lifetime of signed URLs described by opts,
+// or zero if the backend should not sign URLs.
+func newLinkExpiry(opts map[string]string) (time.Duration, error) {
+	v, ok := opts[signedURLExpiry]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || d > maxSignedURLExpiry {
+		return 0, errors.E(errors.Invalid, errors.Errorf("invalid %s %q: must be positive and at most %v", signedURLExpiry, v, maxSignedURLExpiry))
+	}
+	return d, nil
+}
+
+// RefLink implements RefLinker.
+// If the backend signs URLs the link is a V4 signed URL that expires after
+// the configured lifetime. Otherwise it is formed from the LinkBase and
+// does not expire.
+func (gcs *gcsImpl) RefLink(ref string) (string, time.Time, error) {
+	const op errors.Op = "cloud/storage/gcs.RefLink"
+	if gcs.linkExpiry == 0 {
+		base, err := gcs.LinkBase()
+		if err != nil {
+			return "", time.Time{}, errors.E(op, err)
+		}
+		return base + ref, time.Time{}, nil
+	}
+	expires := time.Now().Add(gcs.linkExpiry)
+	url, err := gcs.bucket.SignedURL(gcs.prefix+ref, &gcsBE.SignedURLOptions{
+		GoogleAccessID: gcs.signer,
+		Scheme:         gcsBE.SigningSchemeV4,
+		Method:         "GET",
+		Expires:        expires,
+	})
+	if err != nil {
+		return "", time.Time{}, errors.E(op, errors.Errorf("signing URL for %q: %v", ref, err))
+	}
+	return url, expires, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// ObjectInfo describes the object that stores a ref.
+type ObjectInfo struct {
+	Ref          upspin.Reference
+	Size         int64
+	Created      time.Time
+	Generation   int64
+	StorageClass string
+	// CRC32C and MD5 are the standard base64 encodings of the
+	// checksums of the stored data, as reported by Cloud Storage.
+	// MD5 is empty for composite objects.
+	CRC32C, MD5 string
+}
+
+// ListOptions controls a listing by ListObjects.
+type ListOptions struct {
+	// Prefix restricts the listing to refs that begin with it.
+	Prefix string
+
+	// Parallelism is the number of disjoint ranges of refs that are
+	// listed concurrently. Values less than one mean one, and it is at
+	// most maxListParallelism.
+	Parallelism int
+
+	// Token, if not empty, is a token passed to the callback of an
+	// earlier listing, which is resumed from that point. The Prefix and
+	// Parallelism of the earlier listing are used and those above are
+	// ignored.
+	Token string
+}
+
+// maxListParallelism is the maximum parallelism of ListObjects.
+// The ranges are split at hexadecimal digits, the alphabet of refs that
+// are SHA-256 hashes, so more ranges would not divide the work further.
+const maxListParallelism = 16
+
+// ObjectLister is implemented by storage backends that can list the
+// objects they store in bulk, with their metadata.
+type ObjectLister interface {
+	// ListObjects lists the objects selected by opts, calling fn with
+	// each page of objects. Pages from different ranges are interleaved
+	// but fn is never called concurrently. The token passed to fn may be
+	// saved and used to resume the listing, even in another process,
+	// after the objects passed to fn so far; objects listed after they
+	// are passed to fn are not listed again.
+	// The final call for each range may pass no objects, to record that
+	// the range is done in the token.
+	// If fn returns an error, listing stops and ListObjects returns it.
+	ListObjects(opts ListOptions, fn func(objs []ObjectInfo, token string) error) error
+}
+
+// Guarantee we implement the ObjectLister interface.
+var _ ObjectLister = (*gcsImpl)(nil)
+
+// listAttrs are the object attributes that populate an ObjectInfo.
+var listAttrs = []string{"Name", "Size", "Created", "Generation", "StorageClass", "CRC32C", "MD5"}
+
+// listState records the progress of a listing.
+// It is the content of a ListObjects token.
+type listState struct {
+	Prefix string      `json:"prefix,omitempty"`
+	Ranges []listRange `json:"ranges"`
+}
+
+// listRange is a range of refs that is listed in order.
+type listRange struct {
+	Start string `json:"start,omitempty"` // The first ref in the range; empty for no lower bound.
+	End   string `json:"end,omitempty"`   // The ref after the last in the range; empty for no upper bound.
+	After string `json:"after,omitempty"` // The last ref listed so far, if any.
+	Done  bool   `json:"done,omitempty"`
+}
+
+// query returns the query for the refs that remain to be listed in the range,
+// which include r.After if it is set.
+func (r *listRange) query(prefix string) gcsBE.Query {
+	q := gcsBE.Query{Prefix: prefix, StartOffset: r.Start, EndOffset: r.End}
+	if r.After != "" {
+		q.StartOffset = r.After
+	}
+	return q
+}
+
+// newListState returns the initial state of a listing of the refs with the
+// given prefix, divided into n ranges.
+func newListState(prefix string, n int) *listState {
+	const hexDigits = "0123456789abcdef"
+	if n < 1 {
+		n = 1
+	}
+	if n > maxListParallelism {
+		n = maxListParallelism
+	}
+	s := &listState{Prefix: prefix}
+	start := ""
+	for i := 1; i < n; i++ {
+		end := prefix + hexDigits[i*len(hexDigits)/n:][:1]
+		s.Ranges = append(s.Ranges, listRange{Start: start, End: end})
+		start = end
+	}
+	s.Ranges = append(s.Ranges, listRange{Start: start})
+	return s
+}
+
+// decodeListState decodes a ListObjects token.
+func decodeListState(token string) (*listState, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, errors.Errorf("bad list token: %v", err))
+	}
+	s := new(listState)
+	if err := json.Unmarshal(b, s); err != nil || len(s.Ranges) == 0 {
+		return nil, errors.E(errors.Invalid, errors.Errorf("bad list token %q", token))
+	}
+	return s, nil
+}
+
+// token returns the ListObjects token that resumes the listing.
+func (s *listState) token() string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		// Cannot happen.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ListObjects implements ObjectLister.
+// Each page of a range is listed by a new query that starts at the last ref
+// listed, rather than by following Cloud Storage page tokens, so that the
+// token passed to fn does not expire.
+func (gcs *gcsImpl) ListObjects(opts ListOptions, fn func(objs []ObjectInfo, token string) error) error {
+	const op errors.Op = "cloud/storage/gcs.ListObjects"
+	state := newListState(opts.Prefix, opts.Parallelism)
+	if opts.Token != "" {
+		var err error
+		state, err = decodeListState(opts.Token)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	var (
+		mu       sync.Mutex // Protects state and firstErr and serializes calls to fn.
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := range state.Ranges {
+		if state.Ranges[i].Done {
+			continue
+		}
+		wg.Add(1)
+		go func(r *listRange) {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if firstErr != nil {
+					mu.Unlock()
+					return
+				}
+				q, after := r.query(state.Prefix), r.After
+				mu.Unlock()
+
+				// The page starts with the object listed last, if any,
+				// so it must have room for at least one more.
+				n := maxResults
+				if n < 2 {
+					n = 2
+				}
+				ctx, cancel := gcs.opContext(gcs.timeouts.list)
+				objs, next, err := gcs.listPage(ctx, q, n, "", listAttrs...)
+				cancel()
+				if err == nil && len(objs) > 0 && objs[0].Name == after {
+					objs = objs[1:]
+				}
+
+				mu.Lock()
+				if firstErr != nil {
+					mu.Unlock()
+					return
+				}
+				if err != nil {
+					firstErr = toUpspinError(op, err)
+					mu.Unlock()
+					return
+				}
+				if len(objs) > 0 {
+					r.After = objs[len(objs)-1].Name
+				}
+				r.Done = next == ""
+				if len(objs) > 0 || r.Done {
+					if err := fn(objectInfos(objs), state.token()); err != nil {
+						firstErr = err
+					}
+				}
+				done := r.Done
+				mu.Unlock()
+				if done {
+					return
+				}
+			}
+		}(&state.Ranges[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// objectInfos converts objects' attributes to ObjectInfos.
+func objectInfos(objs []*gcsBE.ObjectAttrs) []ObjectInfo {
+	infos := make([]ObjectInfo, len(objs))
+	for i, o := range objs {
+		infos[i] = ObjectInfo{
+			Ref:          upspin.Reference(o.Name),
+			Size:         o.Size,
+			Created:      o.Created,
+			Generation:   o.Generation,
+			StorageClass: o.StorageClass,
+			CRC32C:       encodeCRC32C(o.CRC32C),
+			MD5:          encodeMD5(o.MD5),
+		}
+	}
+	return infos
+}
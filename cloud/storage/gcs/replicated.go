@@ -0,0 +1,570 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/shutdown"
+	"upspin.io/upspin"
+)
+
+// Keys used for storing the options of the replicated backend,
+// in addition to those of the GCS backend, which apply to every bucket.
+const (
+	// replicaBuckets is a semicolon-separated list of the buckets that
+	// hold copies of the data in the gcpBucketName bucket, the primary.
+	// Data is read from the first healthy bucket that has it, trying the
+	// primary and then the replicas in the order given, so the buckets
+	// nearest the server should come first.
+	replicaBuckets = "gcpReplicaBuckets"
+
+	// replicationMode is either "sync", the default, in which Put and
+	// Delete return once every bucket is updated, or "async", in which
+	// they return once the primary is updated, and the replicas are
+	// updated in the background from the replication queue. Queued
+	// writes are copied between buckets by Cloud Storage, so the data
+	// is not sent by the server a second time.
+	replicationMode = "replicationMode"
+
+	// replicationQueueDir is a local directory holding the queue of
+	// updates still to be made to the replicas. It is required in async
+	// mode. In sync mode, if it is set, updates that fail for a replica
+	// are queued and retried rather than failing the operation.
+	// The queue survives restarts of the server.
+	replicationQueueDir = "replicationQueueDir"
+
+	// replicationRetryInterval is how often queued updates are retried,
+	// in the format accepted by time.ParseDuration. The default is 30s.
+	replicationRetryInterval = "replicationRetryInterval"
+)
+
+// replicaDownTime is how long a bucket is avoided for reads
+// after an operation on it fails.
+const replicaDownTime = 30 * time.Second
+
+// replicationStats holds counters of the replicated backend's work,
+// published as the expvar "cloud/storage/gcs.replication".
+// Divergence between the buckets is reported by "missing", reads that
+// found a ref absent from a bucket that should have held it, and
+// "queued", updates not yet applied to every bucket.
+var replicationStats = expvar.NewMap("cloud/storage/gcs.replication")
+
+// Names of the counters in replicationStats.
+const (
+	replQueued     = "queued"     // Updates added to the queue.
+	replApplied    = "applied"    // Queued updates applied.
+	replFailed     = "failed"     // Attempts to apply queued updates that failed.
+	replFallbacks  = "fallbacks"  // Reads served by a bucket other than the first tried.
+	replMissing    = "missing"    // Reads that found a ref missing from a bucket.
+	replQueueDepth = "queueDepth" // Updates in the queue when last counted.
+)
+
+// replica is one of the buckets of a replicated backend.
+type replica struct {
+	*gcsImpl
+
+	mu        sync.Mutex
+	downUntil time.Time // Reads avoid the bucket until then.
+}
+
+// healthy reports whether reads should use the bucket.
+func (r *replica) healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().After(r.downUntil)
+}
+
+// record records the outcome of an operation on the bucket. An error
+// other than one reporting a missing ref marks the bucket as unhealthy.
+func (r *replica) record(err error) {
+	if err == nil || errors.Is(errors.NotExist, err) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().After(r.downUntil) {
+		log.Error.Printf("cloud/storage/gcs: bucket %q unhealthy: %v", r.bucketName, err)
+	}
+	r.downUntil = time.Now().Add(replicaDownTime)
+}
+
+// replicated is an implementation of Storage that keeps copies of its
+// data in several Google Cloud Storage buckets.
+type replicated struct {
+	replicas []*replica // The primary first.
+	async    bool
+	queueDir string // Empty if there is no queue.
+	interval time.Duration
+	wake     chan struct{} // Wakes the queue processor.
+
+	queueMu sync.Mutex // Held while the queue is processed.
+	entryMu sync.Mutex // Held while a queue entry is written or removed.
+}
+
+// NewReplicated initializes a Storage implementation that stores data to
+// several Google Cloud Storage buckets, surviving the loss of all but one.
+// It is registered as the "GCSReplicated" backend.
+func NewReplicated(opts *storage.Opts) (storage.Storage, error) {
+	const op errors.Op = "cloud/storage/gcs.NewReplicated"
+
+	var names []string
+	for _, name := range strings.Split(opts.Opts[replicaBuckets], ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("%q option is required", replicaBuckets))
+	}
+	r := &replicated{
+		queueDir: opts.Opts[replicationQueueDir],
+		interval: 30 * time.Second,
+		wake:     make(chan struct{}, 1),
+	}
+	switch mode := opts.Opts[replicationMode]; mode {
+	case "", "sync":
+	case "async":
+		r.async = true
+		if r.queueDir == "" {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("%q option is required in async mode", replicationQueueDir))
+		}
+	default:
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("unknown %s %q", replicationMode, mode))
+	}
+	if v, ok := opts.Opts[replicationRetryInterval]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("invalid %s %q", replicationRetryInterval, v))
+		}
+		r.interval = d
+	}
+	if r.queueDir != "" {
+		if err := os.MkdirAll(r.queueDir, 0700); err != nil {
+			return nil, errors.E(op, errors.IO, err)
+		}
+	}
+
+	primary, ok := opts.Opts[bucketName]
+	if !ok {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("%q option is required", bucketName))
+	}
+	for i, name := range append([]string{primary}, names...) {
+		bopts := &storage.Opts{Opts: make(map[string]string)}
+		for k, v := range opts.Opts {
+			bopts.Opts[k] = v
+		}
+		bopts.Opts[bucketName] = name
+		if i > 0 {
+			// Only the primary may use the cache directory.
+			delete(bopts.Opts, cacheDir)
+		}
+		s, err := New(bopts)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+		r.replicas = append(r.replicas, &replica{gcsImpl: s.(*gcsImpl)})
+	}
+
+	if r.queueDir != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		shutdown.Handle(cancel)
+		go r.processQueue(ctx)
+	}
+	return r, nil
+}
+
+func init() {
+	storage.Register("GCSReplicated", NewReplicated)
+}
+
+// Guarantee we implement the storage.Storage interface.
+var _ storage.Storage = (*replicated)(nil)
+
+// Guarantee we implement the storage.Lister interface.
+var _ storage.Lister = (*replicated)(nil)
+
+// LinkBase implements storage.Storage.
+// Links are to the primary bucket.
+func (r *replicated) LinkBase() (base string, err error) {
+	return r.replicas[0].LinkBase()
+}
+
+// Download implements storage.Storage.
+// It reads from the first healthy bucket that has the ref. If none of them
+// do, it tries the unhealthy ones too.
+func (r *replicated) Download(ref string) ([]byte, error) {
+	const op errors.Op = "cloud/storage/gcs.replicated.Download"
+	data, err := r.download(ref, nil)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return data, nil
+}
+
+// download reads ref from the first bucket that has it, other than skip.
+func (r *replicated) download(ref string, skip *replica) ([]byte, error) {
+	var firstErr error
+	tried, missing := 0, 0
+	for _, healthy := range []bool{true, false} {
+		for _, rep := range r.replicas {
+			if rep == skip || rep.healthy() != healthy {
+				continue
+			}
+			data, err := rep.Download(ref)
+			rep.record(err)
+			tried++
+			if err == nil {
+				if tried > 1 {
+					replicationStats.Add(replFallbacks, 1)
+				}
+				// The buckets that lacked the ref have diverged.
+				replicationStats.Add(replMissing, int64(missing))
+				return data, nil
+			}
+			if errors.Is(errors.NotExist, err) {
+				missing++
+			}
+			if firstErr == nil || errors.Is(errors.NotExist, firstErr) {
+				// Prefer reporting an error other than NotExist,
+				// as the ref may be in the bucket that failed.
+				firstErr = err
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// Put implements storage.Storage.
+func (r *replicated) Put(ref string, contents []byte) error {
+	const op errors.Op = "cloud/storage/gcs.replicated.Put"
+	err := r.update(queueEntry{Op: "put", Ref: ref}, func(rep *replica) error {
+		return rep.Put(ref, contents)
+	})
+	if err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// Delete implements storage.Storage.
+// The ref is deleted from every bucket, even if it is missing from some.
+// It reports NotExist only if the ref was missing from every bucket
+// updated before it returns.
+func (r *replicated) Delete(ref string) error {
+	const op errors.Op = "cloud/storage/gcs.replicated.Delete"
+	var missing int32
+	err := r.update(queueEntry{Op: "delete", Ref: ref}, func(rep *replica) error {
+		err := rep.Delete(ref)
+		if errors.Is(errors.NotExist, err) {
+			atomic.AddInt32(&missing, 1)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return errors.E(op, err)
+	}
+	updated := len(r.replicas)
+	if r.async {
+		updated = 1
+	}
+	if int(missing) == updated {
+		return errors.E(op, errors.NotExist, errors.Errorf("%q does not exist", ref))
+	}
+	return nil
+}
+
+// update applies an update to the primary and then the replicas, in
+// parallel, or queues it for the replicas in async mode. If an update of a
+// replica fails and there is a queue, the update is queued for that replica.
+func (r *replicated) update(e queueEntry, apply func(*replica) error) error {
+	primary := r.replicas[0]
+	err := apply(primary)
+	primary.record(err)
+	if err != nil {
+		return err
+	}
+	if r.async {
+		var firstErr error
+		for _, rep := range r.replicas[1:] {
+			e.Bucket = rep.bucketName
+			if err := r.enqueue(e); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	errs := make([]error, len(r.replicas))
+	var wg sync.WaitGroup
+	for i, rep := range r.replicas[1:] {
+		wg.Add(1)
+		go func(i int, rep *replica) {
+			defer wg.Done()
+			errs[i] = apply(rep)
+			rep.record(errs[i])
+		}(i, rep)
+	}
+	wg.Wait()
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if r.queueDir != "" {
+			e.Bucket = r.replicas[i+1].bucketName
+			log.Error.Printf("cloud/storage/gcs: %s %q in bucket %q failed, queued for retry: %v", e.Op, e.Ref, e.Bucket, err)
+			err = r.enqueue(e)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// List implements storage.Lister.
+// It lists the primary bucket.
+func (r *replicated) List(token string) (refs []upspin.ListRefsItem, nextToken string, err error) {
+	return r.replicas[0].List(token)
+}
+
+// queueEntry is an update still to be applied to a replica.
+// It is stored as JSON in a file in the queue directory.
+type queueEntry struct {
+	Op     string // "put" or "delete".
+	Ref    string
+	Bucket string // The replica to update.
+}
+
+// fileName returns the name of the file that holds the entry.
+// Only the latest update of a ref in a bucket need be applied,
+// so the name identifies the ref and bucket but not the operation.
+func (e queueEntry) fileName() string {
+	sum := sha256.Sum256([]byte(e.Bucket + "\x00" + e.Ref))
+	return hex.EncodeToString(sum[:])
+}
+
+// enqueue adds an entry to the queue and wakes the queue processor.
+func (r *replicated) enqueue(e queueEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.E(errors.Internal, err)
+	}
+	tmp, err := ioutil.TempFile(r.queueDir, ".entry")
+	if err != nil {
+		return errors.E(errors.IO, err)
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		r.entryMu.Lock()
+		err = os.Rename(tmp.Name(), filepath.Join(r.queueDir, e.fileName()))
+		r.entryMu.Unlock()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.E(errors.IO, err)
+	}
+	replicationStats.Add(replQueued, 1)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// processQueue applies queued updates when woken and periodically,
+// until the context is canceled.
+func (r *replicated) processQueue(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.flushQueue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// flushQueue tries once to apply every queued update,
+// removing those that succeed from the queue.
+func (r *replicated) flushQueue() {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+	files, err := ioutil.ReadDir(r.queueDir)
+	if err != nil {
+		log.Error.Printf("cloud/storage/gcs: reading replication queue: %v", err)
+		return
+	}
+	depth := 0
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(r.queueDir, fi.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error.Printf("cloud/storage/gcs: reading replication queue: %v", err)
+			depth++
+			continue
+		}
+		var e queueEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			log.Error.Printf("cloud/storage/gcs: discarding bad replication queue entry %s: %v", fi.Name(), err)
+			r.removeEntry(path, b)
+			continue
+		}
+		if err := r.apply(e); err != nil {
+			log.Error.Printf("cloud/storage/gcs: %s %q in bucket %q failed: %v", e.Op, e.Ref, e.Bucket, err)
+			replicationStats.Add(replFailed, 1)
+			depth++
+			continue
+		}
+		if !r.removeEntry(path, b) {
+			// The entry was replaced while being applied.
+			depth++
+		}
+		replicationStats.Add(replApplied, 1)
+	}
+	v := new(expvar.Int)
+	v.Set(int64(depth))
+	replicationStats.Set(replQueueDepth, v)
+}
+
+// removeEntry removes the queue entry at path if it still holds b, and
+// reports whether it did. An entry that enqueue has since replaced is kept.
+func (r *replicated) removeEntry(path string, b []byte) bool {
+	r.entryMu.Lock()
+	defer r.entryMu.Unlock()
+	if b2, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(b2, b) {
+		return false
+	}
+	os.Remove(path)
+	return true
+}
+
+// apply applies a queued update to its replica. Data to put is copied
+// from another bucket by Cloud Storage, without passing through the server.
+func (r *replicated) apply(e queueEntry) error {
+	var target *replica
+	for _, rep := range r.replicas {
+		if rep.bucketName == e.Bucket {
+			target = rep
+		}
+	}
+	if target == nil {
+		// The bucket is no longer a replica.
+		return nil
+	}
+	var err error
+	switch e.Op {
+	case "put":
+		err = r.copyTo(target, e.Ref)
+		if errors.Is(errors.NotExist, err) {
+			// The ref has since been deleted.
+			return nil
+		}
+	case "delete":
+		err = target.Delete(e.Ref)
+		if errors.Is(errors.NotExist, err) {
+			err = nil
+		}
+	default:
+		log.Error.Printf("cloud/storage/gcs: discarding replication queue entry with unknown op %q", e.Op)
+		return nil
+	}
+	target.record(err)
+	return err
+}
+
+// copyTo copies ref to the target replica from the first other bucket that
+// has it, trying the healthy buckets first. In write-once verify mode, the
+// data is instead downloaded and put, so that a copy already in the target
+// is checked against it.
+func (r *replicated) copyTo(target *replica, ref string) error {
+	if target.writeOnce == writeOnceVerify {
+		data, err := r.download(ref, target)
+		if err != nil {
+			return err
+		}
+		return target.Put(ref, data)
+	}
+	var firstErr error
+	for _, healthy := range []bool{true, false} {
+		for _, rep := range r.replicas {
+			if rep == target || rep.healthy() != healthy {
+				continue
+			}
+			err := target.copyFrom(rep.gcsImpl, ref)
+			if err == nil {
+				return nil
+			}
+			if firstErr == nil || errors.Is(errors.NotExist, firstErr) {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// copyFrom copies ref from the bucket of src with a rewrite call, written
+// with the backend's ACL, encryption and storage class, as by Put. The
+// buckets share the options of the replicated backend, so src's object
+// prefix and encryption key are also the backend's. If the backend is
+// write-once and ref exists, it is left as it is.
+func (gcs *gcsImpl) copyFrom(src *gcsImpl, ref string) (err error) {
+	const op errors.Op = "cloud/storage/gcs.replicated.copy"
+	ctx, cancel := gcs.opContext(gcs.timeouts.put)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+
+	ctx, call := gcs.startCall(ctx, "Rewrite", ref)
+	dst := gcs.object(ctx, ref)
+	if gcs.writeOnce != writeOnceOff {
+		dst = dst.If(gcsBE.Conditions{DoesNotExist: true})
+		call.existOK = true
+	}
+	c := dst.CopierFrom(src.object(ctx, ref))
+	c.PredefinedACL = gcs.defaultWriteACL
+	c.DestinationKMSKeyName = gcs.kmsKeyName
+	c.StorageClass = gcs.storageClass
+	attrs, err := c.Run(ctx)
+	if err == nil {
+		call.addSize(attrs.Size)
+	}
+	call.end(err)
+	if gcs.existed(err) {
+		return nil
+	}
+	if err != nil {
+		return toUpspinError(op, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"context"
+	goerrors "errors"
+	"net"
+	"net/http"
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+	gax "github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Keys used for storing the retry policy options.
+// Their values are in the format accepted by time.ParseDuration.
+const (
+	// retryInitialBackoff is the time to wait before the first retry.
+	retryInitialBackoff = "retryInitialBackoff"
+	// retryMaxBackoff is the longest time to wait between retries.
+	retryMaxBackoff = "retryMaxBackoff"
+	// retryMaxElapsed is the time after which an operation that keeps
+	// failing is abandoned. A value of zero disables retries.
+	retryMaxElapsed = "retryMaxElapsed"
+)
+
+// retryPolicy describes how operations that fail with a transient error
+// are retried by the Cloud Storage client. The wait between attempts grows
+// exponentially, with jitter, from initial up to max.
+type retryPolicy struct {
+	initial    time.Duration
+	max        time.Duration
+	maxElapsed time.Duration
+}
+
+// defaultRetryPolicy is the retry policy used when no options override it.
+var defaultRetryPolicy = retryPolicy{
+	initial:    100 * time.Millisecond,
+	max:        5 * time.Second,
+	maxElapsed: 30 * time.Second,
+}
+
+// newRetryPolicy returns the retry policy described by opts,
+// using the default for any value that is not set.
+func newRetryPolicy(opts map[string]string) (*retryPolicy, error) {
+	p := defaultRetryPolicy
+	for _, o := range []struct {
+		key string
+		d   *time.Duration
+	}{
+		{retryInitialBackoff, &p.initial},
+		{retryMaxBackoff, &p.max},
+		{retryMaxElapsed, &p.maxElapsed},
+	} {
+		v, ok := opts[o.key]
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, errors.E(errors.Invalid, errors.Errorf("invalid %s %q", o.key, v))
+		}
+		*o.d = d
+	}
+	if p.initial <= 0 || p.max < p.initial {
+		return nil, errors.E(errors.Invalid, errors.Errorf("%s must be positive and no greater than %s", retryInitialBackoff, retryMaxBackoff))
+	}
+	return &p, nil
+}
+
+// options returns options that make an operation started now
+// retry according to the policy. Retries are counted in the call
+// carried by ctx, if any.
+func (p *retryPolicy) options(ctx context.Context) []gcsBE.RetryOption {
+	retry := p.shouldRetry(time.Now())
+	c := callFrom(ctx)
+	return []gcsBE.RetryOption{
+		gcsBE.WithBackoff(*p.backoff()),
+		// Refs are content addresses, so writing one again is harmless
+		// and all operations may be retried.
+		gcsBE.WithPolicy(gcsBE.RetryAlways),
+		gcsBE.WithErrorFunc(func(err error) bool {
+			if !retry(err) {
+				return false
+			}
+			if c != nil {
+				c.retried()
+			}
+			return true
+		}),
+	}
+}
+
+// backoff returns the backoff between attempts of an operation.
+func (p *retryPolicy) backoff() *gax.Backoff {
+	return &gax.Backoff{
+		Initial:    p.initial,
+		Max:        p.max,
+		Multiplier: 2,
+	}
+}
+
+// shouldRetry returns a function that reports whether an operation
+// started at the given time should be retried after failing with err.
+func (p *retryPolicy) shouldRetry(start time.Time) func(err error) bool {
+	return func(err error) bool {
+		if !isRetryable(err) || time.Since(start) >= p.maxElapsed {
+			return false
+		}
+		log.Info.Printf("cloud/storage/gcs: WARNING: retrying: %s", err)
+		return true
+	}
+}
+
+// isRetryable reports whether err is a transient failure that
+// may succeed if the request is repeated.
+func isRetryable(err error) bool {
+	switch httpStatus(err) {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	var netErr net.Error
+	return goerrors.As(err, &netErr) && netErr.Timeout()
+}
+
+// httpStatus returns the HTTP status of the response that produced err,
+// which may be an Upspin error wrapping an error from the Cloud Storage
+// client, or 0 if it is not known. A nil error means success. The error
+// may be wrapped, as the client library does with some.
+// It classifies errors both for retries and for the traces of calls.
+func httpStatus(err error) int {
+	for {
+		e, ok := err.(*errors.Error)
+		if !ok {
+			break
+		}
+		err = e.Err
+	}
+	if err == nil {
+		return http.StatusOK
+	}
+	var gerr *googleapi.Error
+	if goerrors.As(err, &gerr) {
+		return gerr.Code
+	}
+	if goerrors.Is(err, gcsBE.ErrObjectNotExist) || goerrors.Is(err, gcsBE.ErrBucketNotExist) {
+		return http.StatusNotFound
+	}
+	return 0
+}
+
+// toUpspinError converts an error returned by the Cloud Storage API
+// to an Upspin error of the appropriate kind.
+func toUpspinError(op errors.Op, err error) error {
+	if _, ok := err.(*errors.Error); ok {
+		return errors.E(op, err)
+	}
+	if isRetryable(err) {
+		// The retry policy has given up on the operation.
+		return errors.E(op, errors.Transient, err)
+	}
+	switch httpStatus(err) {
+	case http.StatusNotFound:
+		return errors.E(op, errors.NotExist, err)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return errors.E(op, errors.Invalid, err)
+	case http.StatusPreconditionFailed:
+		return errors.E(op, errors.Exist, err)
+	}
+	return errors.E(op, err)
+}
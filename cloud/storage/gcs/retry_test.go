@@ -0,0 +1,127 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+
+	"upspin.io/errors"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	p, err := newRetryPolicy(map[string]string{
+		retryInitialBackoff: "10ms",
+		retryMaxElapsed:     "1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := retryPolicy{
+		initial:    10 * time.Millisecond,
+		max:        defaultRetryPolicy.max,
+		maxElapsed: time.Minute,
+	}
+	if *p != want {
+		t.Errorf("got policy %+v, want %+v", *p, want)
+	}
+
+	for _, opts := range []map[string]string{
+		{retryInitialBackoff: "soon"},
+		{retryMaxElapsed: "-1s"},
+		{retryInitialBackoff: "0s"},
+		{retryInitialBackoff: "2s", retryMaxBackoff: "1s"},
+	} {
+		if _, err := newRetryPolicy(opts); !errors.Is(errors.Invalid, err) {
+			t.Errorf("newRetryPolicy(%v): got error %v, want Invalid", opts, err)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	p := &retryPolicy{
+		initial:    time.Millisecond,
+		max:        4 * time.Millisecond,
+		maxElapsed: time.Minute,
+	}
+	retry := p.shouldRetry(time.Now())
+	if !retry(&googleapi.Error{Code: 503}) {
+		t.Error("503 error not retried")
+	}
+	if retry(&googleapi.Error{Code: 404}) {
+		t.Error("404 error retried")
+	}
+
+	// Once the maximum elapsed time has passed, nothing is retried.
+	retry = p.shouldRetry(time.Now().Add(-2 * time.Minute))
+	if retry(&googleapi.Error{Code: 503}) {
+		t.Error("503 error retried after maximum elapsed time")
+	}
+
+	// A zero maximum elapsed time disables retries.
+	p.maxElapsed = 0
+	if p.shouldRetry(time.Now())(&googleapi.Error{Code: 503}) {
+		t.Error("503 error retried with retries disabled")
+	}
+}
+
+func TestToUpspinError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind errors.Kind
+	}{
+		{&googleapi.Error{Code: 503}, errors.Transient},
+		{&googleapi.Error{Code: 404}, errors.NotExist},
+		{&googleapi.Error{Code: 416}, errors.Invalid},
+		{&googleapi.Error{Code: 412}, errors.Exist},
+		{gcsBE.ErrObjectNotExist, errors.NotExist},
+		{fmt.Errorf("upload: %w", &googleapi.Error{Code: 503}), errors.Transient},
+		{fmt.Errorf("read: %w", &googleapi.Error{Code: 404}), errors.NotExist},
+		{fmt.Errorf("attrs: %w", gcsBE.ErrObjectNotExist), errors.NotExist},
+		{errors.E(errors.IO, errors.Str("checksum mismatch")), errors.IO},
+	} {
+		if got := toUpspinError("op", tc.err); !errors.Is(tc.kind, got) {
+			t.Errorf("toUpspinError(%v) = %v, want kind %v", tc.err, got, tc.kind)
+		}
+	}
+}
+
+// timeoutError is a net.Error that reports a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 502}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 504}, true},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{fmt.Errorf("upload: %w", &googleapi.Error{Code: 503}), true},
+		{fmt.Errorf("read: %w", &googleapi.Error{Code: 404}), false},
+		{timeoutError{}, true},
+		{fmt.Errorf("dial: %w", timeoutError{}), true},
+		{errors.Str("some error"), false},
+	} {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("isRetryable(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// Streamer is an optional interface implemented by storage backends that can
+// transfer data without holding an entire blob in memory.
+type Streamer interface {
+	// PutStream stores the data read from r, until EOF, under ref.
+	PutStream(ref string, r io.Reader) error
+
+	// DownloadRange returns a reader for length bytes of the data stored
+	// under ref, starting at offset. If length is negative the data is
+	// read to its end. The caller must close the returned reader.
+	DownloadRange(ref string, offset, length int64) (io.ReadCloser, error)
+}
+
+// PutStream stores the data read from r under ref in s. If s implements
+// Streamer the data is streamed to the backend, otherwise it is read into
+// memory and stored with s.Put.
+func PutStream(s storage.Storage, ref string, r io.Reader) error {
+	if st, ok := s.(Streamer); ok {
+		return st.PutStream(ref, r)
+	}
+	const op errors.Op = "cloud/storage/gcs.PutStream"
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+	return s.Put(ref, b)
+}
+
+// DownloadRange returns a reader for length bytes of the data stored under ref
+// in s, starting at offset. If length is negative the data is read to its end.
+// If s implements Streamer the data is streamed from the backend, otherwise
+// it is fetched in full with s.Download.
+func DownloadRange(s storage.Storage, ref string, offset, length int64) (io.ReadCloser, error) {
+	if st, ok := s.(Streamer); ok {
+		return st.DownloadRange(ref, offset, length)
+	}
+	const op errors.Op = "cloud/storage/gcs.DownloadRange"
+	b, err := s.Download(ref)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := readRange(ref, b, offset, length)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return rc, nil
+}
+
+// readRange returns a reader for length bytes of b, the data stored under
+// ref, starting at offset, or for the rest of b if length is negative.
+func readRange(ref string, b []byte, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > int64(len(b)) {
+		return nil, errors.E(errors.Invalid, errors.Errorf("offset %d out of range for %q of size %d", offset, ref, len(b)))
+	}
+	b = b[offset:]
+	if length >= 0 && length < int64(len(b)) {
+		b = b[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
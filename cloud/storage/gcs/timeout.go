@@ -0,0 +1,85 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"upspin.io/errors"
+)
+
+// Keys used for storing the per-operation timeout options.
+// Their values are in the format accepted by time.ParseDuration.
+// Each timeout covers a whole operation, including any retries;
+// a value of zero means the operation has no deadline.
+const (
+	putTimeout      = "putTimeout"
+	downloadTimeout = "downloadTimeout"
+	deleteTimeout   = "deleteTimeout"
+	listTimeout     = "listTimeout"
+)
+
+// timeouts holds the deadlines applied to each kind of operation.
+type timeouts struct {
+	put, download, delete, list time.Duration
+}
+
+// defaultTimeouts are the timeouts used when no options override them.
+var defaultTimeouts = timeouts{
+	put:      10 * time.Minute,
+	download: 10 * time.Minute,
+	delete:   time.Minute,
+	list:     time.Minute,
+}
+
+// newTimeouts returns the timeouts described by opts,
+// using the default for any value that is not set.
+func newTimeouts(opts map[string]string) (*timeouts, error) {
+	t := defaultTimeouts
+	for _, o := range []struct {
+		key string
+		d   *time.Duration
+	}{
+		{putTimeout, &t.put},
+		{downloadTimeout, &t.download},
+		{deleteTimeout, &t.delete},
+		{listTimeout, &t.list},
+	} {
+		v, ok := opts[o.key]
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, errors.E(errors.Invalid, errors.Errorf("invalid %s %q", o.key, v))
+		}
+		*o.d = d
+	}
+	return &t, nil
+}
+
+// opContext returns a context for an operation with the given timeout.
+// The context is also canceled when the backend is shut down.
+func (gcs *gcsImpl) opContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(gcs.ctx)
+	}
+	return context.WithTimeout(gcs.ctx, timeout)
+}
+
+// cancelOnClose is an io.ReadCloser that cancels
+// the context of its request when it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
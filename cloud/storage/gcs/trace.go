@@ -0,0 +1,169 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"gcp.upspin.io/cloud/spanerr"
+
+	"upspin.io/errors"
+	"upspin.io/metric"
+)
+
+// Operations of the backend are recorded as metrics, which a registered
+// metric.Saver such as gcpmetric's exports as traces. Each operation is the
+// root span of its metric, and each call it makes to the Cloud Storage API,
+// such as an Insert or a Get, is a child span of kind metric.Client. As spans
+// carry no labels, a call's span is annotated with its labels in the form
+//	bucket=<name> ref=<ref> size=<bytes> retries=<n> status=<code>
+// and marked with spanerr.Mark if the call failed. The status is the HTTP
+// status of the last attempt, or 0 if it received no response. A download
+// of an object that does not exist is not marked as failed, as that is its
+// answer. A call made outside of a traced operation is recorded as a metric
+// of its own.
+
+// onTrace is called with each metric recorded by the backend before it is
+// handed to the saver. It's used in tests only.
+var onTrace = func(*metric.Metric) {}
+
+// traceKey is the context key for the root span of a traced operation.
+type traceKey struct{}
+
+// callKey is the context key for the call in progress.
+type callKey struct{}
+
+// traceOp starts a metric for the operation and returns a context
+// carrying its root span. The caller must call endOp when the operation
+// is complete.
+func traceOp(ctx context.Context, op errors.Op) (context.Context, *metric.Span) {
+	_, span := metric.NewSpan(metric.SpanName(op))
+	return withSpan(ctx, span), span
+}
+
+// withSpan returns a context derived from ctx that carries the root span
+// of a traced operation.
+func withSpan(ctx context.Context, span *metric.Span) context.Context {
+	return context.WithValue(ctx, traceKey{}, span)
+}
+
+// endOp ends the operation's root span, marking it with spanerr.Mark
+// if the operation failed, and hands its metric to the saver.
+func endOp(span *metric.Span, err error) {
+	if err != nil {
+		span.SetAnnotation(spanerr.Mark(""))
+	}
+	m := span.End()
+	onTrace(m)
+	m.Done()
+}
+
+// endDownload is endOp for a download, which has not failed if the
+// object does not exist.
+func endDownload(span *metric.Span, err error) {
+	if errors.Is(errors.NotExist, err) {
+		err = nil
+	}
+	endOp(span, err)
+}
+
+// gcsCall is a call to the Cloud Storage API, recorded as a span.
+type gcsCall struct {
+	span    *metric.Span
+	root    bool // Whether span is the root of its own metric.
+	bucket  string
+	ref     string // Empty for calls that are not about one ref.
+	size    int64  // Accessed atomically.
+	retries int32  // Accessed atomically.
+
+	// existOK is set if a failed precondition that the object does
+	// not exist is not an error.
+	existOK bool
+
+	// missingOK is set if the object not existing is not an error.
+	missingOK bool
+}
+
+// startCall starts a span for the named call to the Cloud Storage API about
+// ref, as a child of the operation traced by ctx, if any. It returns a
+// context that carries the call, so that the retry policy may count its
+// retries. The caller must call end when the call is complete.
+func (gcs *gcsImpl) startCall(ctx context.Context, name, ref string) (context.Context, *gcsCall) {
+	c := &gcsCall{bucket: gcs.bucketName, ref: ref}
+	spanName := metric.SpanName("cloud/storage/gcs." + name)
+	if parent, ok := ctx.Value(traceKey{}).(*metric.Span); ok {
+		c.span = parent.StartSpan(spanName)
+	} else {
+		_, c.span = metric.NewSpan(spanName)
+		c.root = true
+	}
+	c.span.SetKind(metric.Client)
+	return context.WithValue(ctx, callKey{}, c), c
+}
+
+// callFrom returns the call carried by ctx, or nil if there is none.
+func callFrom(ctx context.Context) *gcsCall {
+	c, _ := ctx.Value(callKey{}).(*gcsCall)
+	return c
+}
+
+// retried records that the call was retried.
+func (c *gcsCall) retried() {
+	atomic.AddInt32(&c.retries, 1)
+}
+
+// addSize records that n more bytes, or objects for a listing,
+// were transferred by the call.
+func (c *gcsCall) addSize(n int64) {
+	atomic.AddInt64(&c.size, n)
+}
+
+// end ends the call's span, annotating it with its labels.
+// The error is that returned by the call, if any.
+func (c *gcsCall) end(err error) {
+	a := fmt.Sprintf("bucket=%s", c.bucket)
+	if c.ref != "" {
+		a += fmt.Sprintf(" ref=%s", c.ref)
+	}
+	status := httpStatus(err)
+	a += fmt.Sprintf(" size=%d retries=%d status=%d",
+		atomic.LoadInt64(&c.size), atomic.LoadInt32(&c.retries), status)
+	if err != nil && !(c.existOK && status == http.StatusPreconditionFailed) &&
+		!(c.missingOK && status == http.StatusNotFound) {
+		a = spanerr.Mark(a)
+	}
+	m := c.span.SetAnnotation(a).End()
+	if c.root {
+		onTrace(m)
+		m.Done()
+	}
+}
+
+// tracedReader is an io.ReadCloser that records the bytes read through it
+// in a call, and ends the call when it is closed.
+type tracedReader struct {
+	io.ReadCloser
+	call *gcsCall
+	err  error // The first error other than io.EOF returned by Read.
+}
+
+func (r *tracedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.call.addSize(int64(n))
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *tracedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.call.end(r.err)
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"strconv"
+	"time"
+
+	gcsBE "cloud.google.com/go/storage"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// keepDeletedVersions, if "true", declares that deleted objects must be
+// recoverable: the bucket must have object versioning enabled, so that
+// Delete leaves a noncurrent version of each object it deletes rather than
+// removing it permanently. Noncurrent versions are kept until the bucket's
+// lifecycle rules remove them, which sets the window within which they may
+// be restored.
+const keepDeletedVersions = "keepDeletedVersions"
+
+// NoncurrentVersion describes a noncurrent version of an object,
+// left behind when the object was deleted or overwritten in a bucket
+// with object versioning.
+type NoncurrentVersion struct {
+	Ref        upspin.Reference
+	Size       int64
+	Generation int64
+	Deleted    time.Time // When the version became noncurrent.
+}
+
+// Restorer is implemented by storage backends that can restore
+// deleted refs.
+type Restorer interface {
+	// Restore makes the most recent noncurrent version of ref live again.
+	// It returns an error of kind NotExist if there is no such version,
+	// and of kind Exist if ref is already live.
+	Restore(ref string) error
+
+	// ListNoncurrent returns a page of noncurrent versions, in order of
+	// ref then generation, and a token from which to continue the listing.
+	// The first page is returned for the empty token, and the last page
+	// returns an empty token. A page may be empty even if more follow.
+	ListNoncurrent(token string) (versions []NoncurrentVersion, nextToken string, err error)
+}
+
+// Guarantee we implement the Restorer interface.
+var _ Restorer = (*gcsImpl)(nil)
+
+// newKeepDeleted reports whether opts require deleted objects
+// to be kept as noncurrent versions.
+func newKeepDeleted(opts map[string]string) (bool, error) {
+	v, ok := opts[keepDeletedVersions]
+	if !ok {
+		return false, nil
+	}
+	keep, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.E(errors.Invalid, errors.Errorf("invalid %s %q", keepDeletedVersions, v))
+	}
+	return keep, nil
+}
+
+// Restore implements Restorer.
+// It copies the noncurrent version to a new live version, which is written
+// with the backend's current ACL, storage class and encryption settings.
+func (gcs *gcsImpl) Restore(ref string) (err error) {
+	const op errors.Op = "cloud/storage/gcs.Restore"
+	ctx, cancel := gcs.opContext(gcs.timeouts.list)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+
+	gen := int64(0)
+	q := gcsBE.Query{Prefix: ref, Versions: true}
+	token := ""
+	for {
+		objs, next, err := gcs.listPage(ctx, q, maxResults, token, "Name", "Generation", "Deleted")
+		if err != nil {
+			return toUpspinError(op, err)
+		}
+		for _, o := range objs {
+			if o.Name != ref {
+				continue
+			}
+			if o.Deleted.IsZero() {
+				return errors.E(op, errors.Exist, errors.Str("ref is live"))
+			}
+			if o.Generation > gen {
+				gen = o.Generation
+			}
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if gen == 0 {
+		return errors.E(op, errors.NotExist, errors.Str("no noncurrent version"))
+	}
+
+	ctx, cancel = gcs.opContext(gcs.timeouts.put)
+	defer cancel()
+	ctx, call := gcs.startCall(withSpan(ctx, span), "Rewrite", ref)
+	dst := gcs.object(ctx, ref).If(gcsBE.Conditions{DoesNotExist: true})
+	c := dst.CopierFrom(gcs.object(ctx, ref).Generation(gen))
+	c.PredefinedACL = gcs.defaultWriteACL
+	c.DestinationKMSKeyName = gcs.kmsKeyName
+	c.StorageClass = gcs.storageClass
+	attrs, err := c.Run(ctx)
+	if err == nil {
+		call.addSize(attrs.Size)
+	}
+	call.end(err)
+	if err != nil {
+		return toUpspinError(op, err)
+	}
+	return nil
+}
+
+// ListNoncurrent implements Restorer.
+func (gcs *gcsImpl) ListNoncurrent(token string) (versions []NoncurrentVersion, nextToken string, err error) {
+	const op errors.Op = "cloud/storage/gcs.ListNoncurrent"
+	ctx, cancel := gcs.opContext(gcs.timeouts.list)
+	defer cancel()
+	ctx, span := traceOp(ctx, op)
+	defer func() { endOp(span, err) }()
+	q := gcsBE.Query{Versions: true}
+	objs, nextToken, err := gcs.listPage(ctx, q, maxResults, token, "Name", "Size", "Generation", "Deleted")
+	if err != nil {
+		return nil, "", toUpspinError(op, err)
+	}
+	for _, o := range objs {
+		if o.Deleted.IsZero() {
+			continue
+		}
+		versions = append(versions, NoncurrentVersion{
+			Ref:        upspin.Reference(o.Name),
+			Size:       o.Size,
+			Generation: o.Generation,
+			Deleted:    o.Deleted,
+		})
+	}
+	return versions, nextToken, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"context"
+	"net/http"
+
+	"upspin.io/errors"
+)
+
+// writeOnceOption controls whether Put and PutStream may overwrite an
+// existing object. Its value is one of
+//
+//	false   objects are overwritten (the default)
+//	true    an existing object is left untouched and the write succeeds
+//	verify  as true, but the write fails with an errors.Exist if the
+//	        existing object's size and checksums differ from the data
+//
+// As refs are content addresses, rewriting an existing ref only wastes an
+// upload, unless something is badly wrong; write-once mode guards against
+// the latter, and saves the former when the same block is stored twice.
+const writeOnceOption = "writeOnce"
+
+// writeOnceMode is the value of the writeOnce option.
+type writeOnceMode int
+
+const (
+	writeOnceOff writeOnceMode = iota
+	writeOnceOn
+	writeOnceVerify
+)
+
+// newWriteOnce returns the write-once mode requested by opts.
+func newWriteOnce(opts map[string]string) (writeOnceMode, error) {
+	switch v := opts[writeOnceOption]; v {
+	case "", "false":
+		return writeOnceOff, nil
+	case "true":
+		return writeOnceOn, nil
+	case "verify":
+		return writeOnceVerify, nil
+	default:
+		return 0, errors.E(errors.Invalid, errors.Errorf("%s must be false, true or verify, not %q", writeOnceOption, v))
+	}
+}
+
+// existed reports whether err is the failure of a write-once upload
+// because the object already exists.
+func (gcs *gcsImpl) existed(err error) bool {
+	return gcs.writeOnce != writeOnceOff && httpStatus(err) == http.StatusPreconditionFailed
+}
+
+// checkExisting is called when a write-once upload of ref finds that it
+// already exists. In verify mode, it checks that the existing object holds
+// the data, whose size and checksums are in sums, and returns an
+// errors.Exist if it does not. Checksums that Cloud Storage did not
+// report are not checked.
+func (gcs *gcsImpl) checkExisting(ctx context.Context, ref string, sums *checksums) (err error) {
+	if gcs.writeOnce != writeOnceVerify {
+		return nil
+	}
+	ctx, call := gcs.startCall(ctx, "Get", ref)
+	defer func() { call.end(err) }()
+	attrs, err := gcs.object(ctx, ref).Attrs(ctx)
+	if err != nil {
+		return toUpspinError("", err)
+	}
+	if attrs.Size != sums.size {
+		return errors.E(errors.Exist, errors.Errorf("%q exists with size %d, not %d", ref, attrs.Size, sums.size))
+	}
+	crc32c := ""
+	if attrs.CRC32C != 0 {
+		crc32c = encodeCRC32C(attrs.CRC32C)
+	}
+	if err := sums.verify(ref, crc32c, encodeMD5(attrs.MD5)); err != nil {
+		return errors.E(errors.Exist, errors.Errorf("%q exists with different contents: %v", ref, err))
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ package main // import "gcp.upspin.io/cmd/dirserver-gcp"
 
 import (
 	"flag"
+	"time"
 
 	cloudLog "gcp.upspin.io/cloud/log"
 	"upspin.io/log"
@@ -33,6 +34,10 @@ const (
 	serverName    = "dirserver"
 	samplingRatio = 1    // report all metrics
 	maxQPS        = 1000 // unlimited metric reports per second
+
+	// monitoringPeriod is the interval at which aggregated
+	// metrics are written to Cloud Monitoring.
+	monitoringPeriod = time.Minute
 )
 
 func main() {
@@ -42,12 +47,15 @@ func main() {
 
 	if *project != "" {
 		cloudLog.Connect(*project, serverName)
-		svr, err := gcpmetric.NewSaver(*project, samplingRatio, maxQPS, "serverName", serverName)
+		svr, err := gcpmetric.NewSpanSaver(*project, samplingRatio, maxQPS, "serverName", serverName)
 		if err != nil {
 			log.Fatalf("Can't start a metric saver for GCP project %q: %s", *project, err)
-		} else {
-			metric.RegisterSaver(svr)
 		}
+		mon, err := gcpmetric.NewMonitoringSaver(*project, monitoringPeriod, "serverName", serverName)
+		if err != nil {
+			log.Fatalf("Can't start a monitoring saver for GCP project %q: %s", *project, err)
+		}
+		metric.RegisterSaver(gcpmetric.Multi(svr, mon))
 	}
 
 	https.ListenAndServe(ready, serverName)
@@ -29,6 +29,9 @@ import (
 	"strings"
 	"time"
 
+	"gcp.upspin.io/cloud/storage/gcs"
+
+	upspinstorage "upspin.io/cloud/storage"
 	"upspin.io/config"
 
 	"cloud.google.com/go/storage"
@@ -37,7 +40,7 @@ import (
 	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
 	"google.golang.org/api/googleapi"
-	"google.golang.org/api/iterator"
+	monitoring "google.golang.org/api/monitoring/v3"
 	"google.golang.org/api/option"
 )
 
@@ -56,6 +59,7 @@ var requiredAPIs = []string{
 	"container",
 	"dns.googleapis.com",
 	"logging.googleapis.com",
+	"monitoring.googleapis.com",
 	"storage_api",
 }
 
@@ -887,6 +891,7 @@ func (c *Config) createCluster() error {
 					storage.ScopeReadWrite,
 					// Required to write metrics.
 					cloudtrace.TraceAppendScope,
+					monitoring.MonitoringWriteScope,
 				},
 				Metadata: map[string]string{
 					"letsencrypt-bucket": c.bucketName("letsencrypt"),
@@ -969,23 +974,33 @@ func (c *Config) deleteBuckets() error {
 		name := c.bucketName(s)
 		log.Printf("Deleting bucket %q", name)
 
+		_, err := client.Bucket(name).Attrs(ctx)
+		if err == storage.ErrBucketNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
 		// Delete bucket contents.
-		it := client.Bucket(name).Objects(ctx, nil)
-		for {
-			o, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return okReason("notFound", err)
-			}
-			err = okReason("notFound", client.Bucket(name).Object(o.Name).Delete(ctx))
-			if err != nil && err != storage.ErrObjectNotExist {
-				return err
-			}
+		be, err := upspinstorage.Dial("GCS",
+			upspinstorage.WithKeyValue("gcpBucketName", name),
+			upspinstorage.WithKeyValue("defaultACL", gcs.Uniform))
+		if err != nil {
+			return err
+		}
+		err = be.(gcs.Drainer).Drain(gcs.DrainOptions{
+			Confirm:     name,
+			Concurrency: 50,
+			Progress: func(p gcs.DrainProgress) {
+				log.Printf("Bucket %q: deleted %d of %d objects", name, p.Deleted, p.Listed)
+			},
+		})
+		if err != nil {
+			return err
 		}
 
-		err := client.Bucket(name).Delete(ctx)
+		err = client.Bucket(name).Delete(ctx)
 		if err := okReason("notFound", err); err != nil {
 			return err
 		}
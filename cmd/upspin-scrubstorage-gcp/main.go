@@ -0,0 +1,379 @@
+// Copyright 2026 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The upspin-scrubstorage-gcp command is an external upspin subcommand that
+// checks the consistency of a Google Cloud Storage bucket used by a store
+// server with the directory trees that refer to it.
+// Run upspin scrubstorage-gcp -help for more information.
+package main // import "gcp.upspin.io/cmd/upspin-scrubstorage-gcp"
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gcp.upspin.io/cloud/storage/gcs"
+
+	"upspin.io/client"
+	"upspin.io/cloud/storage"
+	"upspin.io/config"
+	"upspin.io/subcmd"
+	"upspin.io/transports"
+	"upspin.io/upspin"
+)
+
+type state struct {
+	*subcmd.State
+}
+
+const help = `
+Scrubstorage-gcp compares the refs stored in the Google Cloud Storage bucket of
+a store server with the refs that directory entries point to. It reports
+orphans, refs in the bucket that no directory entry points to, and dangling
+references, refs that directory entries point to but that are missing from the
+bucket.
+
+The bucket is the one named in the store configuration written by
+'upspin setupstorage-gcp' to $where/$domain. The referenced refs are read from
+the file named by -refs, one per line, or gathered by walking the directory
+trees of the users named by -users, using the Upspin configuration named by
+-config, or both. Walking a tree finds only the entries that the configured
+user may list. It does not find the blocks in which a directory server stores
+its trees, nor the blocks of users that are not named, although the store
+server may hold them too.
+
+Orphans created within the -grace period are ignored, as they may belong to
+files that are being written. With -delete, the orphans are deleted;
+otherwise they are only reported. As a walk cannot find every referenced ref,
+-delete requires -refs, which must list them all: the blocks of every tree
+served by every directory server that uses the store server, including the
+blocks that hold the trees themselves. Run without -delete first and check
+the orphans that are reported.
+
+With -checkpoint, progress is recorded in the named file so that an
+interrupted scrub may be resumed by running the command again with the same
+flags. The checkpoint is removed when the scrub completes.
+
+Orphans are printed to standard output as lines of the form
+	orphan <ref> <size> <creation time>
+and dangling references as
+	dangling <ref>
+`
+
+func main() {
+	const name = "scrubstorage-gcp"
+
+	log.SetFlags(0)
+	log.SetPrefix("upspin scrubstorage-gcp: ")
+
+	s := &state{
+		State: subcmd.NewState(name),
+	}
+
+	where := flag.String("where", filepath.Join(os.Getenv("HOME"), "upspin", "deploy"), "`directory` containing private configuration files")
+	domain := flag.String("domain", "", "domain `name` for this Upspin installation")
+	configFile := flag.String("config", filepath.Join(os.Getenv("HOME"), "upspin", "config"), "Upspin configuration `file` used to walk directory trees")
+	refsFile := flag.String("refs", "", "`file` listing referenced refs, one per line (- for standard input)")
+	users := flag.String("users", "", "comma-separated `list` of users whose directory trees to walk")
+	grace := flag.Duration("grace", 7*24*time.Hour, "ignore orphans created within this `duration`")
+	del := flag.Bool("delete", false, "delete orphans rather than only reporting them; requires -refs")
+	checkpoint := flag.String("checkpoint", "", "`file` in which to record progress, to resume an interrupted scrub")
+	parallel := flag.Int("parallel", 8, "`number` of ranges of the bucket to list in parallel")
+
+	s.ParseFlags(flag.CommandLine, os.Args[1:], help,
+		"scrubstorage-gcp -domain=<name> [-refs=<file>] [-users=<user>,...] [-delete]")
+	if flag.NArg() != 0 {
+		s.Exitf("unexpected arguments")
+	}
+	if *domain == "" {
+		s.Exitf("the -domain flag must be provided")
+	}
+	if *refsFile == "" && *users == "" {
+		s.Exitf("at least one of the -refs and -users flags must be provided")
+	}
+	if *del && *refsFile == "" {
+		s.Exitf("-delete requires -refs, as walking the -users trees does not find every referenced ref")
+	}
+
+	store := s.dialStore(filepath.Join(*where, *domain))
+	lister, ok := store.(gcs.ObjectLister)
+	if !ok {
+		s.Exitf("the store backend cannot list its objects")
+	}
+
+	refs := make(map[upspin.Reference]bool)
+	if *refsFile != "" {
+		s.readRefs(*refsFile, refs)
+	}
+	if *users != "" {
+		cfg, err := config.FromFile(*configFile)
+		if err != nil {
+			s.Exit(err)
+		}
+		transports.Init(cfg)
+		c := client.New(cfg)
+		for _, u := range strings.Split(*users, ",") {
+			s.walk(c, upspin.PathName(strings.TrimSpace(u)+"/"), refs)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Found %d referenced refs.\n", len(refs))
+
+	sc := &scrubber{
+		State:    s.State,
+		store:    store,
+		refs:     refs,
+		seen:     make(map[upspin.Reference]bool),
+		grace:    *grace,
+		delete:   *del,
+		progress: *checkpoint,
+	}
+	sc.load()
+	err := lister.ListObjects(gcs.ListOptions{Parallelism: *parallel, Token: sc.Token}, sc.scrub)
+	if err != nil {
+		s.Exit(err)
+	}
+	for ref := range refs {
+		if !sc.seen[ref] {
+			fmt.Printf("dangling %s\n", ref)
+			sc.Dangling++
+		}
+	}
+	sc.finish()
+
+	fmt.Fprintf(os.Stderr, "Listed %d refs; found %d orphans (%d bytes) and %d dangling references.\n",
+		sc.Listed, sc.Orphans, sc.OrphanBytes, sc.Dangling)
+	if *del {
+		fmt.Fprintf(os.Stderr, "Deleted %d orphans.\n", sc.Orphans-sc.DeleteErrors)
+	}
+	if sc.DeleteErrors > 0 {
+		s.Exitf("%d orphans could not be deleted", sc.DeleteErrors)
+	}
+	s.ExitNow()
+}
+
+// dialStore connects to the store backend described by the store
+// configuration in the server configuration in dir.
+func (s *state) dialStore(dir string) storage.Storage {
+	cfg := s.ReadServerConfig(dir)
+	backend := ""
+	var opts []storage.DialOpts
+	for _, kv := range cfg.StoreConfig {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			s.Exitf("bad store configuration %q", kv)
+		}
+		if k, v := kv[:i], kv[i+1:]; k == "backend" {
+			backend = v
+		} else {
+			opts = append(opts, storage.WithKeyValue(k, v))
+		}
+	}
+	if backend == "" {
+		s.Exitf("no store backend configured in %s", dir)
+	}
+	store, err := storage.Dial(backend, opts...)
+	if err != nil {
+		s.Exit(err)
+	}
+	return store
+}
+
+// readRefs adds the refs listed in the named file to refs.
+func (s *state) readRefs(file string, refs map[upspin.Reference]bool) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			s.Exit(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		if ref := strings.TrimSpace(scan.Text()); ref != "" {
+			refs[upspin.Reference(ref)] = true
+		}
+	}
+	if err := scan.Err(); err != nil {
+		s.Exit(err)
+	}
+}
+
+// walk adds the refs of the blocks of the named directory, and of every
+// entry beneath it, to refs.
+func (s *state) walk(c upspin.Client, dir upspin.PathName, refs map[upspin.Reference]bool) {
+	entry, err := c.Lookup(dir, false)
+	if err != nil {
+		s.Exit(err)
+	}
+	s.walkEntry(c, entry, refs)
+}
+
+// walkEntry adds the refs of the blocks of the entry, and of every entry
+// beneath it if it is a directory, to refs. Links are not followed.
+// Any failure is fatal, as a partial walk would report live refs as orphans.
+func (s *state) walkEntry(c upspin.Client, entry *upspin.DirEntry, refs map[upspin.Reference]bool) {
+	if entry.IsIncomplete() {
+		s.Exitf("no read access to %s", entry.Name)
+	}
+	addBlocks(entry, refs)
+	if !entry.IsDir() {
+		return
+	}
+	entries, err := c.Glob(strings.TrimSuffix(string(entry.Name), "/") + "/*")
+	if err != nil {
+		s.Exit(err)
+	}
+	for _, e := range entries {
+		if !e.IsLink() {
+			s.walkEntry(c, e, refs)
+		}
+	}
+}
+
+// addBlocks adds the refs of the entry's blocks to refs.
+func addBlocks(e *upspin.DirEntry, refs map[upspin.Reference]bool) {
+	for _, b := range e.Blocks {
+		refs[b.Location.Reference] = true
+	}
+}
+
+// scrubber holds the state of a scrub. Its exported fields are recorded
+// in the checkpoint file.
+type scrubber struct {
+	*subcmd.State `json:"-"`
+
+	store    storage.Storage
+	refs     map[upspin.Reference]bool // The referenced refs.
+	seen     map[upspin.Reference]bool // The referenced refs found in the bucket.
+	grace    time.Duration
+	delete   bool
+	progress string   // The checkpoint file; empty if there is none.
+	seenFile *os.File // Records the refs in seen, if there is a checkpoint.
+
+	Token        string // The token that resumes the listing.
+	Listed       int64
+	Orphans      int64
+	OrphanBytes  int64
+	DeleteErrors int64
+	Dangling     int64 `json:"-"`
+}
+
+// load loads the checkpoint, if any. The refs found so far are recorded
+// in a separate file, appended to as the scrub proceeds.
+func (sc *scrubber) load() {
+	if sc.progress == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(sc.progress)
+	switch {
+	case os.IsNotExist(err):
+		os.Remove(sc.seenName())
+	case err != nil:
+		sc.Exit(err)
+	default:
+		if err := json.Unmarshal(b, sc); err != nil {
+			sc.Exitf("bad checkpoint %s: %v", sc.progress, err)
+		}
+		fmt.Fprintf(os.Stderr, "Resuming from checkpoint after %d refs.\n", sc.Listed)
+		sc.readSeen()
+	}
+	sc.seenFile, err = os.OpenFile(sc.seenName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		sc.Exit(err)
+	}
+}
+
+// seenName returns the name of the file recording the refs in sc.seen.
+func (sc *scrubber) seenName() string {
+	return sc.progress + ".seen"
+}
+
+// readSeen reads the refs found before the checkpoint was written.
+func (sc *scrubber) readSeen() {
+	f, err := os.Open(sc.seenName())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		sc.Exit(err)
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		sc.seen[upspin.Reference(scan.Text())] = true
+	}
+	if err := scan.Err(); err != nil {
+		sc.Exit(err)
+	}
+}
+
+// scrub is the ListObjects callback that checks a page of objects.
+func (sc *scrubber) scrub(objs []gcs.ObjectInfo, token string) error {
+	var seen []string
+	for _, o := range objs {
+		sc.Listed++
+		if sc.refs[o.Ref] {
+			sc.seen[o.Ref] = true
+			seen = append(seen, string(o.Ref)+"\n")
+			continue
+		}
+		if time.Since(o.Created) < sc.grace {
+			continue
+		}
+		fmt.Printf("orphan %s %d %s\n", o.Ref, o.Size, o.Created.Format(time.RFC3339))
+		sc.Orphans++
+		sc.OrphanBytes += o.Size
+		if sc.delete {
+			if err := sc.store.Delete(string(o.Ref)); err != nil {
+				log.Printf("deleting %s: %v", o.Ref, err)
+				sc.DeleteErrors++
+			}
+		}
+	}
+	sc.Token = token
+	if sc.progress == "" {
+		return nil
+	}
+	// Record the refs found before the checkpoint that refers to them.
+	if _, err := io.WriteString(sc.seenFile, strings.Join(seen, "")); err != nil {
+		return err
+	}
+	if err := sc.seenFile.Sync(); err != nil {
+		return err
+	}
+	return sc.save()
+}
+
+// save writes the checkpoint.
+func (sc *scrubber) save() error {
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	tmp := sc.progress + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sc.progress)
+}
+
+// finish removes the checkpoint of a completed scrub.
+func (sc *scrubber) finish() {
+	if sc.progress == "" {
+		return
+	}
+	sc.seenFile.Close()
+	os.Remove(sc.progress)
+	os.Remove(sc.seenName())
+}
@@ -9,13 +9,17 @@ package main // import "gcp.upspin.io/cmd/upspin-setupstorage-gcp"
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 
 	"golang.org/x/oauth2/google"
+	cloudkms "google.golang.org/api/cloudkms/v1"
 	"google.golang.org/api/googleapi"
 	iam "google.golang.org/api/iam/v1"
 	storage "google.golang.org/api/storage/v1"
@@ -34,9 +38,29 @@ if you wish to store Upspin data on your server's local disk.
 The first step is 'setupdomain' and the final step is 'setupserver'.
 
 Setupstorage-gcp creates a Google Cloud Storage bucket and a service account for
-accessing that bucket. It then writes the service account private key to
-$where/$domain/serviceaccount.json and updates the server configuration files
-in that directory to use the specified bucket.
+accessing that bucket. It then updates the server configuration files in
+$where/$domain to use the specified bucket, with credentials chosen by the
+-auth flag:
+
+	key          a new private key for the service account (the default)
+	default      none; the server must run as the service account, for
+	             instance on Compute Engine or through GKE Workload Identity
+	impersonate  none; the server impersonates the service account, and the
+	             IAM member named by -member is allowed to do so
+	external     the external account configuration in the file named by
+	             -external-account, for workload identity federation; the
+	             principal named by -member is allowed to act as the
+	             service account
+
+Only the key mode creates a long-lived service account key. For the impersonate
+mode, the member is typically the service account the server runs as:
+	-member=serviceAccount:<account>@<project>.iam.gserviceaccount.com
+For the external mode, it is the federated identities that may act as the
+service account, such as
+	-member=principalSet://iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/*
+and the configuration must be created to impersonate the service account:
+	$ gcloud iam workload-identity-pools create-cred-config <provider> \
+		--service-account=upspinstorage@<project>.iam.gserviceaccount.com ...
 
 Before running this command, you must create a Google Cloud Project and
 associated Billing Account using the Cloud Console:
@@ -52,6 +76,27 @@ Authenticate and enable the necessary APIs:
 And, finally, authenticate again in a different way:
 	$ gcloud auth application-default login
 
+By default the bucket uses fine-grained access control and objects are written
+with the publicRead ACL. With the -uniform flag the bucket is instead created
+with uniform bucket-level access, the service account is granted access to its
+objects through the bucket's IAM policy, and all users are granted read access
+the same way.
+
+The -kms-key flag names a Cloud KMS key, of the form
+	projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+with which objects in the bucket are encrypted by default. The project's
+Cloud Storage service agent is granted permission to use the key. To do so
+the Cloud KMS API must be enabled:
+	$ gcloud --project <project> services enable cloudkms.googleapis.com
+
+The -nearline-age, -coldline-age and -archive-age flags install lifecycle
+rules on the bucket that move objects to the Nearline, Coldline and Archive
+storage classes once they are the given number of days old. Blocks that are
+rarely read after they are written are cheaper to keep in the colder classes,
+though reading them is slower and is charged. With the -lifecycle flag, the
+command only updates the lifecycle rules of an existing bucket:
+	$ upspin setupstorage-gcp -lifecycle -nearline-age=30 -coldline-age=90 <bucket_name>
+
 Running this command when the service account or bucket exists is a no-op.
 `
 
@@ -68,31 +113,90 @@ func main() {
 	where := flag.String("where", filepath.Join(os.Getenv("HOME"), "upspin", "deploy"), "`directory` to store private configuration files")
 	domain := flag.String("domain", "", "domain `name` for this Upspin installation")
 	project := flag.String("project", "", "GCP `project` name")
+	auth := flag.String("auth", "key", "`mode` of authentication to the bucket: key, default, impersonate or external")
+	member := flag.String("member", "", "IAM `member` allowed to act as the service account (with -auth=impersonate or external)")
+	externalAccount := flag.String("external-account", "", "external account configuration `file` (with -auth=external)")
+	uniform := flag.Bool("uniform", false, "create the bucket with uniform bucket-level access")
+	kmsKey := flag.String("kms-key", "", "Cloud KMS `key` with which to encrypt objects in the bucket by default")
+	lifecycleOnly := flag.Bool("lifecycle", false, "only update the lifecycle rules of an existing bucket")
+	var ages classAges
+	flag.IntVar(&ages.nearline, "nearline-age", 0, "move objects to Nearline storage after this many `days` (0 means never)")
+	flag.IntVar(&ages.coldline, "coldline-age", 0, "move objects to Coldline storage after this many `days` (0 means never)")
+	flag.IntVar(&ages.archive, "archive-age", 0, "move objects to Archive storage after this many `days` (0 means never)")
 
 	s.ParseFlags(flag.CommandLine, os.Args[1:], help,
 		"setupstorage-gcp -domain=<name> -project=<gcp_project_name> <bucket_name>")
 	if flag.NArg() != 1 {
 		s.Exitf("a single bucket name must be provided")
 	}
+	if err := ages.validate(); err != nil {
+		s.Exit(err)
+	}
+
+	bucket := flag.Arg(0)
+
+	if *lifecycleOnly {
+		s.setLifecycle(bucket, ages)
+		s.ExitNow()
+	}
+
 	if *domain == "" || *project == "" {
 		s.Exitf("the -domain and -project flags must be provided")
 	}
 
-	bucket := flag.Arg(0)
+	switch *auth {
+	case "key", "default":
+	case "impersonate":
+		if *member == "" {
+			s.Exitf("the -member flag must be provided with -auth=impersonate")
+		}
+	case "external":
+		if *member == "" || *externalAccount == "" {
+			s.Exitf("the -member and -external-account flags must be provided with -auth=external")
+		}
+	default:
+		s.Exitf("unknown -auth mode %q", *auth)
+	}
 
 	cfgPath := filepath.Join(*where, *domain)
 	cfg := s.ReadServerConfig(cfgPath)
 
-	email, privateKeyData := s.createServiceAccount(*project)
+	email := s.createServiceAccount(*project)
+	var authConfig []string
+	switch *auth {
+	case "key":
+		authConfig = []string{"privateKeyData=" + s.createKey(*project, email)}
+	case "default":
+		fmt.Fprintf(os.Stderr, "The server must run as service account %q.\n", email)
+	case "impersonate":
+		s.grantServiceAccountRole(*project, email, "roles/iam.serviceAccountTokenCreator", *member)
+		authConfig = []string{"impersonateServiceAccount=" + email}
+	case "external":
+		data := s.readExternalAccount(*externalAccount)
+		s.grantServiceAccountRole(*project, email, "roles/iam.workloadIdentityUser", *member)
+		authConfig = []string{"externalAccountData=" + data}
+	}
 
-	s.createBucket(*project, email, bucket)
+	acl := "publicRead"
+	if *uniform {
+		s.createUniformBucket(*project, email, bucket)
+		acl = "uniform"
+	} else {
+		s.createBucket(*project, email, bucket)
+	}
+	if *kmsKey != "" {
+		s.setDefaultKMSKey(*project, bucket, *kmsKey)
+	}
+	if ages != (classAges{}) {
+		s.setLifecycle(bucket, ages)
+	}
 
 	cfg.StoreConfig = []string{
 		"backend=GCS",
-		"defaultACL=publicRead",
+		"defaultACL=" + acl,
 		"gcpBucketName=" + bucket,
-		"privateKeyData=" + privateKeyData,
 	}
+	cfg.StoreConfig = append(cfg.StoreConfig, authConfig...)
 	s.WriteServerConfig(cfgPath, cfg)
 
 	fmt.Fprintf(os.Stderr, "You should now deploy the upspinserver binary and run 'upspin setupserver'.\n")
@@ -100,16 +204,10 @@ func main() {
 	s.ExitNow()
 }
 
-func (s *state) createServiceAccount(project string) (email, privateKeyData string) {
-	client, err := google.DefaultClient(context.Background(), iam.CloudPlatformScope)
-	if err != nil {
-		// TODO: ask the user to run 'gcloud auth application-default login'
-		s.Exit(err)
-	}
-	svc, err := iam.New(client)
-	if err != nil {
-		s.Exit(err)
-	}
+// createServiceAccount creates the service account through which the server
+// accesses the bucket, if it does not exist, and returns its email address.
+func (s *state) createServiceAccount(project string) (email string) {
+	svc := s.iamService()
 
 	name := "projects/" + project
 	req := &iam.CreateServiceAccountRequest{
@@ -118,7 +216,6 @@ func (s *state) createServiceAccount(project string) (email, privateKeyData stri
 			DisplayName: "Upspin Storage",
 		},
 	}
-	created := true
 	acct, err := svc.Projects.ServiceAccounts.Create(name, req).Do()
 	if isExists(err) {
 		// This should be the name we need to get.
@@ -128,24 +225,74 @@ func (s *state) createServiceAccount(project string) (email, privateKeyData stri
 		if err != nil {
 			s.Exit(err)
 		}
-		created = false
+		fmt.Fprintf(os.Stderr, "Service account %q already exists; re-using it.\n", acct.Email)
 	} else if err != nil {
 		s.Exit(err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Service account %q created.\n", acct.Email)
+	}
+	return acct.Email
+}
+
+// createKey creates a new private key for the service account
+// and returns it in the form of the privateKeyData option.
+func (s *state) createKey(project, email string) (privateKeyData string) {
+	svc := s.iamService()
+	name := "projects/" + project + "/serviceAccounts/" + email
+	key, err := svc.Projects.ServiceAccounts.Keys.Create(name, &iam.CreateServiceAccountKeyRequest{}).Do()
+	if err != nil {
+		s.Exit(err)
 	}
+	fmt.Fprintf(os.Stderr, "A new key for the service account %q was created.\n", email)
+	return key.PrivateKeyData
+}
 
-	name += "/serviceAccounts/" + acct.Email
-	req2 := &iam.CreateServiceAccountKeyRequest{}
-	key, err := svc.Projects.ServiceAccounts.Keys.Create(name, req2).Do()
+// grantServiceAccountRole grants member the role on the service account.
+func (s *state) grantServiceAccountRole(project, email, role, member string) {
+	svc := s.iamService()
+	name := "projects/" + project + "/serviceAccounts/" + email
+	policy, err := svc.Projects.ServiceAccounts.GetIamPolicy(name).Do()
 	if err != nil {
 		s.Exit(err)
 	}
-	if created {
-		fmt.Fprintf(os.Stderr, "Service account %q created.\n", acct.Email)
-	} else {
-		fmt.Fprintf(os.Stderr, "A new key for the service account %q was created.\n", acct.Email)
+	if !addBinding(serviceAccountPolicy{policy}, role, member) {
+		return
 	}
+	_, err = svc.Projects.ServiceAccounts.SetIamPolicy(name, &iam.SetIamPolicyRequest{Policy: policy}).Do()
+	if err != nil {
+		s.Exit(err)
+	}
+	fmt.Fprintf(os.Stderr, "Granted %q the %s role on service account %q.\n", member, role, email)
+}
 
-	return acct.Email, key.PrivateKeyData
+// readExternalAccount reads the external account configuration in the
+// named file and returns it in the form of the externalAccountData option.
+func (s *state) readExternalAccount(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		s.Exit(err)
+	}
+	var cfg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil || cfg.Type != "external_account" {
+		s.Exitf("%s is not an external account configuration", file)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// iamService returns a client for the IAM API.
+func (s *state) iamService() *iam.Service {
+	client, err := google.DefaultClient(context.Background(), iam.CloudPlatformScope)
+	if err != nil {
+		// TODO: ask the user to run 'gcloud auth application-default login'
+		s.Exit(err)
+	}
+	svc, err := iam.New(client)
+	if err != nil {
+		s.Exit(err)
+	}
+	return svc
 }
 
 func (s *state) createBucket(project, email, bucket string) {
@@ -182,6 +329,248 @@ func (s *state) createBucket(project, email, bucket string) {
 	}
 }
 
+// createUniformBucket creates a bucket with uniform bucket-level access and
+// grants the service account full control of its objects, and all users read
+// access to them, through the bucket's IAM policy. The service account is
+// also granted read access to the bucket's metadata, which the storage
+// backend reads to check that its configuration suits the bucket.
+func (s *state) createUniformBucket(project, email, bucket string) {
+	client, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope)
+	if err != nil {
+		// TODO: ask the user to run 'gcloud auth application-default login'
+		s.Exit(err)
+	}
+	svc, err := storage.New(client)
+	if err != nil {
+		s.Exit(err)
+	}
+
+	_, err = svc.Buckets.Insert(project, &storage.Bucket{
+		IamConfiguration: &storage.BucketIamConfiguration{
+			UniformBucketLevelAccess: &storage.BucketIamConfigurationUniformBucketLevelAccess{
+				Enabled: true,
+			},
+		},
+		Name: bucket,
+		// TODO(adg): flag for location
+	}).Do()
+	if isExists(err) {
+		fmt.Fprintf(os.Stderr, "Bucket %q already exists; re-using it.\n", bucket)
+	} else if err != nil {
+		s.Exit(err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Bucket %q created.\n", bucket)
+	}
+
+	policy, err := svc.Buckets.GetIamPolicy(bucket).Do()
+	if err != nil {
+		s.Exit(err)
+	}
+	addBinding(bucketPolicy{policy}, "roles/storage.objectAdmin", "serviceAccount:"+email)
+	addBinding(bucketPolicy{policy}, "roles/storage.legacyBucketReader", "serviceAccount:"+email)
+	addBinding(bucketPolicy{policy}, "roles/storage.objectViewer", "allUsers")
+	if _, err := svc.Buckets.SetIamPolicy(bucket, policy).Do(); err != nil {
+		s.Exit(err)
+	}
+	fmt.Fprintf(os.Stderr, "Granted %q access to objects in bucket %q.\n", email, bucket)
+}
+
+// setDefaultKMSKey grants the project's Cloud Storage service agent use of
+// the Cloud KMS key and makes it the default key for objects in the bucket.
+func (s *state) setDefaultKMSKey(project, bucket, key string) {
+	client, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope, cloudkms.CloudkmsScope)
+	if err != nil {
+		s.Exit(err)
+	}
+	svc, err := storage.New(client)
+	if err != nil {
+		s.Exit(err)
+	}
+	kms, err := cloudkms.New(client)
+	if err != nil {
+		s.Exit(err)
+	}
+
+	agent, err := svc.Projects.ServiceAccount.Get(project).Do()
+	if err != nil {
+		s.Exit(err)
+	}
+	keys := kms.Projects.Locations.KeyRings.CryptoKeys
+	policy, err := keys.GetIamPolicy(key).Do()
+	if err != nil {
+		s.Exit(err)
+	}
+	if addBinding(kmsPolicy{policy}, "roles/cloudkms.cryptoKeyEncrypterDecrypter", "serviceAccount:"+agent.EmailAddress) {
+		if _, err := keys.SetIamPolicy(key, &cloudkms.SetIamPolicyRequest{Policy: policy}).Do(); err != nil {
+			s.Exit(err)
+		}
+	}
+
+	_, err = svc.Buckets.Patch(bucket, &storage.Bucket{
+		Encryption: &storage.BucketEncryption{DefaultKmsKeyName: key},
+	}).Do()
+	if err != nil {
+		s.Exit(err)
+	}
+	fmt.Fprintf(os.Stderr, "Objects in bucket %q are encrypted with key %q by default.\n", bucket, key)
+}
+
+// classAges holds the ages, in days, at which objects move to colder
+// storage classes. Zero means objects never move to that class.
+type classAges struct {
+	nearline, coldline, archive int
+}
+
+// validate checks that the ages are not negative
+// and that objects move to ever colder classes.
+func (a classAges) validate() error {
+	prev, prevClass := 0, ""
+	for _, c := range a.rules() {
+		if c.age < 0 {
+			return fmt.Errorf("the age for %s storage must not be negative", c.class)
+		}
+		if c.age == 0 {
+			continue
+		}
+		if c.age <= prev {
+			return fmt.Errorf("the age for %s storage must be greater than that for %s storage", c.class, prevClass)
+		}
+		prev, prevClass = c.age, c.class
+	}
+	return nil
+}
+
+// classAge is the age, in days, at which objects move to a storage class.
+type classAge struct {
+	class string
+	age   int
+}
+
+// rules returns the storage classes and their ages, from warmest to coldest.
+func (a classAges) rules() []classAge {
+	return []classAge{
+		{"NEARLINE", a.nearline},
+		{"COLDLINE", a.coldline},
+		{"ARCHIVE", a.archive},
+	}
+}
+
+// setLifecycle replaces the bucket's lifecycle rules that change storage
+// classes with ones that move objects to colder classes at the given ages.
+// Other rules are kept.
+func (s *state) setLifecycle(bucket string, ages classAges) {
+	client, err := google.DefaultClient(context.Background(), storage.DevstorageFullControlScope)
+	if err != nil {
+		s.Exit(err)
+	}
+	svc, err := storage.New(client)
+	if err != nil {
+		s.Exit(err)
+	}
+
+	b, err := svc.Buckets.Get(bucket).Do()
+	if err != nil {
+		s.Exit(err)
+	}
+	lifecycle := &storage.BucketLifecycle{
+		// Send an empty list of rules, rather than none,
+		// so that all rules are removed if none are left.
+		ForceSendFields: []string{"Rule"},
+	}
+	if b.Lifecycle != nil {
+		for _, rule := range b.Lifecycle.Rule {
+			if rule.Action != nil && rule.Action.Type == "SetStorageClass" {
+				continue
+			}
+			lifecycle.Rule = append(lifecycle.Rule, rule)
+		}
+	}
+	// Each rule applies to objects in any warmer class.
+	warmer := []string{"STANDARD", "MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY"}
+	for _, c := range ages.rules() {
+		if c.age > 0 {
+			lifecycle.Rule = append(lifecycle.Rule, &storage.BucketLifecycleRule{
+				Action: &storage.BucketLifecycleRuleAction{
+					Type:         "SetStorageClass",
+					StorageClass: c.class,
+				},
+				Condition: &storage.BucketLifecycleRuleCondition{
+					Age:                 googleapi.Int64(int64(c.age)),
+					MatchesStorageClass: append([]string(nil), warmer...),
+				},
+			})
+			fmt.Fprintf(os.Stderr, "Objects in bucket %q move to %s storage after %d days.\n", bucket, c.class, c.age)
+		}
+		warmer = append(warmer, c.class)
+	}
+	if _, err := svc.Buckets.Patch(bucket, &storage.Bucket{Lifecycle: lifecycle}).Do(); err != nil {
+		s.Exit(err)
+	}
+}
+
+// policy is an IAM policy, of which each API has its own type.
+type policy interface {
+	// members returns the members of the policy's binding for role,
+	// creating the binding if necessary.
+	members(role string) *[]string
+}
+
+// addBinding adds member to the policy's binding for role,
+// creating the binding if necessary. It reports whether
+// the policy changed.
+func addBinding(p policy, role, member string) bool {
+	members := p.members(role)
+	for _, m := range *members {
+		if m == member {
+			return false
+		}
+	}
+	*members = append(*members, member)
+	return true
+}
+
+// bucketPolicy is the IAM policy of a Cloud Storage bucket.
+type bucketPolicy struct{ *storage.Policy }
+
+func (p bucketPolicy) members(role string) *[]string {
+	for _, b := range p.Bindings {
+		if b.Role == role {
+			return &b.Members
+		}
+	}
+	b := &storage.PolicyBindings{Role: role}
+	p.Bindings = append(p.Bindings, b)
+	return &b.Members
+}
+
+// serviceAccountPolicy is the IAM policy of a service account.
+type serviceAccountPolicy struct{ *iam.Policy }
+
+func (p serviceAccountPolicy) members(role string) *[]string {
+	for _, b := range p.Bindings {
+		if b.Role == role {
+			return &b.Members
+		}
+	}
+	b := &iam.Binding{Role: role}
+	p.Bindings = append(p.Bindings, b)
+	return &b.Members
+}
+
+// kmsPolicy is the IAM policy of a Cloud KMS key.
+type kmsPolicy struct{ *cloudkms.Policy }
+
+func (p kmsPolicy) members(role string) *[]string {
+	for _, b := range p.Bindings {
+		if b.Role == role {
+			return &b.Members
+		}
+	}
+	b := &cloudkms.Binding{Role: role}
+	p.Bindings = append(p.Bindings, b)
+	return &b.Members
+}
+
 func isExists(err error) bool {
 	if e, ok := err.(*googleapi.Error); ok && len(e.Errors) > 0 {
 		for _, e := range e.Errors {